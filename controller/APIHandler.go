@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/wxt2005/image-capture-bot-go/db"
 	"github.com/wxt2005/image-capture-bot-go/service"
 )
 
@@ -22,8 +23,9 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := struct {
-		URLList *[]string `json:"url"`
-		Force   bool      `json:"force"`
+		URLList  *[]string `json:"url"`
+		Force    bool      `json:"force"`
+		Original bool      `json:"original"`
 	}{
 		Force: false,
 	}
@@ -40,7 +42,7 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 	urlStringList := resp.URLList
 	incomingURLList := serviceManager.BuildIncomingURL(urlStringList)
 	if skipCheckDuplicate != true {
-		incomingURLList, duplicates = extractDuplicate(incomingURLList)
+		incomingURLList, duplicates = extractDuplicate(incomingURLList, submission{Submitter: "api"})
 	}
 
 	if len(duplicates) > 0 {
@@ -53,7 +55,19 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 	mediaList = append(mediaList, serviceManager.ExtraMediaFromURL(incomingURLList)...)
 
 	if len(mediaList) > 0 {
-		serviceManager.ConsumeMedia(mediaList)
+		for _, media := range mediaList {
+			media.SendOriginal = resp.Original
+		}
+		from := submission{Submitter: "api"}
+		if needsModeration(from) {
+			err = submitForModeration(mediaList, from, "")
+		} else {
+			_, err = serviceManager.Publish(mediaList, from.Submitter, nil)
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
 	}
 
 	output.Media = &mediaList
@@ -61,3 +75,42 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 	jsonByte, _ := json.Marshal(output)
 	fmt.Fprintf(w, string(jsonByte))
 }
+
+// LookupHandler reports when and where a content identity was first seen,
+// query with either ?id=twitter:123 or ?url=https://x.com/user/status/123
+func LookupHandler(w http.ResponseWriter, r *http.Request) {
+	serviceManager := service.GetServiceManager()
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json; charset=utf-8"}
+	var output LookupResponse
+
+	query := r.URL.Query()
+	identity := service.CleanIdentity(query.Get("id"))
+	if identity == "" && query.Get("url") != "" {
+		urlStringList := []string{query.Get("url")}
+		if incomingURLList := serviceManager.BuildIncomingURL(&urlStringList); len(incomingURLList) > 0 {
+			identity = incomingURLList[0].Identity
+		}
+	}
+
+	if identity == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	record, err := db.FindURLRecord(identity)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	output.Identity = identity
+	output.Record = record
+	if record != nil {
+		output.Message = MsgSuccess
+	} else {
+		output.Message = MsgNotFound
+	}
+	jsonByte, _ := json.Marshal(output)
+	w.Write(jsonByte)
+}
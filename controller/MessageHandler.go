@@ -2,10 +2,13 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	log "github.com/sirupsen/logrus"
@@ -30,7 +33,14 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 	var output Response
 
 	var update tgbotapi.Update
+	var from submission
+	// replies are in the language of whoever sent the message or pressed the button
+	var lang string
 	skipCheckDuplicate := false
+	// force and retry buttons re-run a single url from the bot's own message
+	onlyURLIndex := -1
+	// a retry edits the status reply it was pressed on
+	var retryStatuses []*service.URLStatus
 	err = json.Unmarshal(body, &update)
 	if err != nil {
 		w.WriteHeader(500)
@@ -45,10 +55,11 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 		userID := update.Message.From.ID
 		chatID := update.Message.Chat.ID
 		messageID := update.Message.MessageID
+		lang = service.UserLanguage(update.Message.From)
 
 		// Handle "/start" command
 		if update.Message.Command() == "start" {
-			go telegramService.SendWelcomeMessage(chatID, messageID)
+			go telegramService.SendWelcomeMessage(chatID, messageID, lang)
 			return
 		}
 
@@ -61,9 +72,9 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if isSuccess {
-				go telegramService.SendAuthMessage(chatID, messageID, true)
+				go telegramService.SendAuthMessage(chatID, messageID, true, lang)
 			} else {
-				go telegramService.SendAuthMessage(chatID, messageID, false)
+				go telegramService.SendAuthMessage(chatID, messageID, false, lang)
 			}
 			return
 		}
@@ -72,18 +83,78 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 		if update.Message.Command() == "revoke" {
 			isSuccess := revokeUserAuth(userID)
 			if isSuccess {
-				go telegramService.SendRevokeMessage(chatID, messageID, true)
+				go telegramService.SendRevokeMessage(chatID, messageID, true, lang)
 			} else {
-				go telegramService.SendRevokeMessage(chatID, messageID, false)
+				go telegramService.SendRevokeMessage(chatID, messageID, false, lang)
 			}
 			return
 		}
 
+		// Handle "/lang xx" command, anyone may pick their language
+		if update.Message.Command() == "lang" {
+			arg := strings.TrimSpace(update.Message.CommandArguments())
+			changed := false
+			if newLang, ok := service.SupportedLanguage(arg); ok {
+				if err := db.SetUserLanguage(userID, newLang); err != nil {
+					log.WithFields(log.Fields{
+						"error": err,
+					}).Error("Save user language failed")
+				} else {
+					lang, changed = newLang, true
+				}
+			}
+			go telegramService.SendLanguageMessage(chatID, messageID, lang, arg, changed)
+			return
+		}
+
+		// Groups with embed on get link previews for everyone instead of submissions
+		if isGroup(update.Message.Chat) {
+			if update.Message.Command() == "embed" {
+				go handleEmbedCommand(update.Message, lang)
+				return
+			}
+			if !update.Message.IsCommand() && embedEnabled(chatID) {
+				go handleEmbed(update.Message)
+				return
+			}
+		}
+
 		// Check auth
 		if !isUserAuthed(userID) {
-			go telegramService.SendNoPremissionMessage(chatID, messageID)
+			go telegramService.SendNoPremissionMessage(chatID, messageID, lang)
+			return
+		}
+
+		// Handle "/queue" and "/now" commands
+		if update.Message.Command() == "queue" || update.Message.Command() == "now" {
+			go handleQueueCommand(update.Message, lang)
 			return
 		}
+
+		// Handle "/delete", "/recaption" and "/repost" commands
+		if update.Message.Command() == "delete" || update.Message.Command() == "recaption" || update.Message.Command() == "repost" {
+			go handlePostCommand(update.Message, lang)
+			return
+		}
+
+		// a moderator answering the edit caption prompt
+		if handleCaptionReply(update.Message, lang) {
+			return
+		}
+
+		from = submission{
+			ChatID:    chatID,
+			MessageID: messageID,
+			UserID:    userID,
+			Submitter: submitterName(update.Message.From),
+		}
+	} else if update.ChannelPost != nil || update.EditedChannelPost != nil {
+		post := update.ChannelPost
+		if post == nil {
+			post = update.EditedChannelPost
+		}
+		go handleChannelPost(post)
+		return
 	} else if update.CallbackQuery != nil {
 		if update.CallbackQuery.From == nil {
 			return
@@ -92,24 +163,79 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 		userID := update.CallbackQuery.From.ID
 		chatID := update.CallbackQuery.Message.Chat.ID
 		messageID := update.CallbackQuery.Message.MessageID
+		lang = service.UserLanguage(update.CallbackQuery.From)
+
+		callbackData := update.CallbackQuery.Data
+		// likes on messages linked to a post count on its primary message
+		likePrimary := messageID
+		if strings.HasPrefix(callbackData, "like_") {
+			primary, err := strconv.Atoi(strings.TrimPrefix(callbackData, "like_"))
+			if err != nil {
+				return
+			}
+			likePrimary = primary
+			callbackData = "like"
+		}
 
-		switch update.CallbackQuery.Data {
+		if strings.HasPrefix(callbackData, "retry_") {
+			// Check auth
+			if !isUserAuthed(userID) {
+				go telegramService.SendNoPremissionMessage(chatID, messageID, lang)
+				return
+			}
+			index, err := strconv.Atoi(strings.TrimPrefix(callbackData, "retry_"))
+			if err != nil {
+				return
+			}
+			go telegramService.DropRetryButton(update.CallbackQuery.Message, index)
+			update.Message = update.CallbackQuery.Message
+			onlyURLIndex = index
+			retryStatuses = telegramService.RestoreStatuses(update.CallbackQuery.Message)
+			from = submission{
+				ChatID:    chatID,
+				MessageID: messageID,
+				UserID:    userID,
+				Submitter: submitterName(update.CallbackQuery.From),
+			}
+			callbackData = "retry"
+		}
+
+		if strings.HasPrefix(callbackData, "approve_") || strings.HasPrefix(callbackData, "reject_") || strings.HasPrefix(callbackData, "caption_") {
+			// Check auth
+			if !isUserAuthed(userID) {
+				go telegramService.SendNoPremissionMessage(chatID, messageID, lang)
+				return
+			}
+			go handleModerationCallback(update.CallbackQuery, lang)
+			w.WriteHeader(200)
+			return
+		}
+
+		switch callbackData {
 		case "like":
-			count, ok := saveLike(chatID, messageID, userID)
+			count, ok := saveLike(chatID, likePrimary, userID)
 			if ok {
-				go telegramService.UpdateLikeButton(chatID, messageID, count)
+				go updateLikeButtons(chatID, likePrimary, count)
 			}
 			w.WriteHeader(200)
 			return
 		case "force":
 			// Check auth
 			if !isUserAuthed(userID) {
-				go telegramService.SendNoPremissionMessage(chatID, messageID)
+				go telegramService.SendNoPremissionMessage(chatID, messageID, lang)
 				return
 			}
 			// extract Message, go through
 			update.Message = update.CallbackQuery.Message
 			skipCheckDuplicate = true
+			// the notice links the duplicate url first, then the earlier post
+			onlyURLIndex = 0
+			from = submission{
+				ChatID:    chatID,
+				MessageID: messageID,
+				UserID:    userID,
+				Submitter: submitterName(update.CallbackQuery.From),
+			}
 		}
 	}
 
@@ -120,18 +246,76 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 	var mediaList []*service.Media
 	var duplicates []*service.IncomingURL
 	urlStringList := telegramService.ExtractURL(update.Message)
+	if onlyURLIndex >= 0 {
+		if onlyURLIndex >= len(urlStringList) {
+			return
+		}
+		urlStringList = urlStringList[onlyURLIndex : onlyURLIndex+1]
+	}
+
+	// every url gets a line in the status reply, updated as processing goes
+	var statuses []*service.URLStatus
+	var incomingURLList []*service.IncomingURL
+	statusOf := make(map[*service.IncomingURL]*service.URLStatus)
+	for _, urlString := range urlStringList {
+		status := &service.URLStatus{URL: urlString, State: service.URLPending}
+		statuses = append(statuses, status)
+
+		if incomingURL, ok := serviceManager.MatchURL(urlString); ok {
+			incomingURLList = append(incomingURLList, incomingURL)
+			statusOf[incomingURL] = status
+		} else {
+			status.State = service.URLUnsupported
+		}
+	}
 
-	incomingURLList := serviceManager.BuildIncomingURL(&urlStringList)
+	chatID := update.Message.Chat.ID
+	statusMessageID := 0
+	if onlyURLIndex >= 0 && onlyURLIndex < len(retryStatuses) {
+		// the retried url takes its line back
+		retryStatuses[onlyURLIndex] = statuses[0]
+		statuses = retryStatuses
+		statusMessageID = update.Message.MessageID
+		telegramService.UpdateStatusMessage(statuses, chatID, statusMessageID, lang)
+	} else if len(statuses) > 0 {
+		statusMessageID, _ = telegramService.SendStatusMessage(statuses, chatID, update.Message.MessageID, lang)
+	}
 
 	if !skipCheckDuplicate {
-		incomingURLList, duplicates = extractDuplicate(incomingURLList)
+		incomingURLList, duplicates = extractDuplicate(incomingURLList, from)
 	}
 
 	if len(duplicates) > 0 {
-		go sendDuplicateMessages(duplicates, update.Message.Chat.ID, update.Message.MessageID)
+		for _, incomingURL := range duplicates {
+			statusOf[incomingURL].State = service.URLDuplicate
+		}
+		go sendDuplicateMessages(duplicates, update.Message.Chat.ID, update.Message.MessageID, lang)
 	}
 
-	mediaList = append(mediaList, serviceManager.ExtraMediaFromURL(incomingURLList)...)
+	var extracted []*service.IncomingURL
+	for _, incomingURL := range incomingURLList {
+		status := statusOf[incomingURL]
+		media, err := serviceManager.ExtractMediaFromIncomingURL(incomingURL)
+		if err == nil && len(media) == 0 {
+			err = errors.New("no media found")
+		}
+
+		if err != nil {
+			status.State = service.URLFailed
+			status.Reason = err.Error()
+			// let the retry pass the dedup check
+			if !skipCheckDuplicate {
+				releaseDuplicate(incomingURL.Identity)
+			}
+		} else {
+			extracted = append(extracted, incomingURL)
+			mediaList = append(mediaList, media...)
+		}
+
+		if statusMessageID != 0 {
+			telegramService.UpdateStatusMessage(statuses, chatID, statusMessageID, lang)
+		}
+	}
 
 	if len(mediaList) == 0 && update.Message.Photo != nil {
 		media, remains, _ := telegramService.ExtractMediaFromMsg(update.Message)
@@ -144,8 +328,54 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// statuses of extracted urls follow what became of their media
+	setExtracted := func(state service.URLState, reason func(identity string) error) {
+		for _, incomingURL := range extracted {
+			status := statusOf[incomingURL]
+			status.State = state
+			if reason == nil {
+				continue
+			}
+			if err := reason(incomingURL.Identity); err != nil {
+				status.State = service.URLFailed
+				status.Reason = err.Error()
+				if !skipCheckDuplicate {
+					releaseDuplicate(incomingURL.Identity)
+				}
+			}
+		}
+		if len(extracted) > 0 && statusMessageID != 0 {
+			telegramService.UpdateStatusMessage(statuses, chatID, statusMessageID, lang)
+		}
+	}
+
 	if len(mediaList) > 0 {
-		serviceManager.ConsumeMedia(mediaList)
+		if telegramService.HasHashtag(update.Message, "original") {
+			for _, media := range mediaList {
+				media.SendOriginal = true
+			}
+		}
+		if needsModeration(from) {
+			err := submitForModeration(mediaList, from, lang)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Submit media for moderation failed")
+			}
+			setExtracted(service.URLReview, func(string) error { return err })
+		} else {
+			position, err := serviceManager.Publish(mediaList, from.Submitter, func(result service.ConsumeResult) {
+				setExtracted(service.URLPosted, result.Err)
+			})
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Queue media failed")
+				setExtracted(service.URLFailed, func(string) error { return err })
+			} else if position > 0 {
+				setExtracted(service.URLQueued, nil)
+			}
+		}
 	}
 
 	output.Media = &mediaList
@@ -199,17 +429,48 @@ func revokeUserAuth(userID int64) bool {
 	return true
 }
 
-func extractDuplicate(incomingURLList []*service.IncomingURL) (remains []*service.IncomingURL, duplicates []*service.IncomingURL) {
+// submission describes who sent a batch of URLs and where
+type submission struct {
+	ChatID    int64
+	MessageID int
+	UserID    int64
+	Submitter string
+}
+
+func submitterName(user *tgbotapi.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+func extractDuplicate(incomingURLList []*service.IncomingURL, from submission) (remains []*service.IncomingURL, duplicates []*service.IncomingURL) {
 	db.DB.Batch(func(tx *bbolt.Tx) error {
+		// Batch may run this function again, start over every time
+		remains, duplicates = nil, nil
 		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
 
 		for _, incomingURL := range incomingURLList {
-			urlString := strings.ToLower(incomingURL.URL)
-			exist := b.Get([]byte(urlString))
+			// a url key the migration couldn't convert, it takes the identity now
+			if renamed, _ := db.RenameLegacyURLKey(b, strings.ToLower(incomingURL.URL), incomingURL.Identity); renamed {
+				duplicates = append(duplicates, incomingURL)
+				continue
+			}
 
-			if exist == nil {
+			if db.GetURLRecord(b, incomingURL.Identity) == nil {
 				remains = append(remains, incomingURL)
-				b.Put([]byte(urlString), []byte("1"))
+				db.PutURLRecord(b, &db.URLRecord{
+					Identity:  incomingURL.Identity,
+					URL:       incomingURL.URL,
+					FirstSeen: time.Now(),
+					ChatID:    from.ChatID,
+					MessageID: from.MessageID,
+					UserID:    from.UserID,
+					Submitter: from.Submitter,
+				})
 			} else {
 				duplicates = append(duplicates, incomingURL)
 			}
@@ -221,12 +482,34 @@ func extractDuplicate(incomingURLList []*service.IncomingURL) (remains []*servic
 	return
 }
 
-func sendDuplicateMessages(incomingURLList []*service.IncomingURL, chatID int64, messageID int) {
+// releaseDuplicate forgets an identity whose extraction failed, unless it was posted before
+func releaseDuplicate(identity string) {
+	if err := db.ReleaseURLRecord(identity); err != nil {
+		log.WithFields(log.Fields{
+			"identity": identity,
+			"error":    err,
+		}).Error("Release url record failed")
+	}
+}
+
+func sendDuplicateMessages(incomingURLList []*service.IncomingURL, chatID int64, messageID int, lang string) {
 	telegramService := service.GetServiceManager().All.Telegram
 
 	for _, incomingURL := range incomingURLList {
 		log.WithField("URL", incomingURL.URL).Debug("Duplicate url")
-		if err := telegramService.SendDuplicateMessage(incomingURL.URL, chatID, messageID); err != nil {
+		record, err := db.FindURLRecord(incomingURL.Identity)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Find url record failed")
+		}
+
+		likeCount := 0
+		if record != nil && len(record.Posts) > 0 {
+			likeCount = countLikes(record.Posts[0].ChatID, record.Posts[0].MessageID)
+		}
+
+		if err := telegramService.SendDuplicateMessage(incomingURL.URL, record, likeCount, chatID, messageID, lang); err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
 			}).Error("Send duplicate message failed")
@@ -271,3 +554,40 @@ func saveLike(chatID int64, messageID int, userID int64) (count int, ok bool) {
 
 	return
 }
+
+// updateLikeButtons refreshes the like count on every message of the post
+func updateLikeButtons(chatID int64, primary int, count int) {
+	telegramService := service.GetServiceManager().All.Telegram
+	messageIDs := []int{primary}
+
+	link, err := db.FindPostLink(chatID, primary)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Find post link failed")
+	}
+	if link != nil {
+		messageIDs = link.Buttons
+	}
+
+	for _, messageID := range messageIDs {
+		telegramService.UpdateLikeButton(chatID, messageID, primary, count)
+	}
+}
+
+func countLikes(chatID int64, messageID int) (count int) {
+	db.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.like_bucket")))
+		key := fmt.Sprintf("chat_%d_msg_%d", chatID, messageID)
+		var value []int64
+
+		if exist := b.Get([]byte(key)); exist != nil {
+			json.Unmarshal(exist, &value)
+		}
+		count = len(value)
+
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/wxt2005/image-capture-bot-go/service"
+)
+
+// channelChat is how the bot addresses a channel, by username when it has one
+func channelChat(chat *tgbotapi.Chat) string {
+	if chat.UserName != "" {
+		return "@" + chat.UserName
+	}
+	return strconv.FormatInt(chat.ID, 10)
+}
+
+// isTransformChannel tells if link-only posts of the channel are replaced, see telegram.transform_channels
+func isTransformChannel(chat *tgbotapi.Chat) bool {
+	for _, channel := range viper.GetStringSlice("telegram.transform_channels") {
+		if strings.EqualFold(channel, "@"+chat.UserName) || channel == strconv.FormatInt(chat.ID, 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// SeedChatAliases lets requests to the channels by id and by @username share a queue from the start
+func SeedChatAliases() {
+	service.GetServiceManager().All.Telegram.SeedChatAliases()
+}
+
+// transforming holds the channel posts being replaced, an edit may arrive while the post is still running
+var transforming sync.Map
+
+// handleChannelPost replaces a post made of links in a transform channel with the media of the links.
+// The link post is deleted once every media was posted, it is left alone otherwise
+func handleChannelPost(post *tgbotapi.Message) {
+	if post.Chat == nil || !isTransformChannel(post.Chat) {
+		return
+	}
+
+	key := fmt.Sprintf("%d_%d", post.Chat.ID, post.MessageID)
+	if _, running := transforming.LoadOrStore(key, true); running {
+		return
+	}
+	defer transforming.Delete(key)
+
+	serviceManager := service.GetServiceManager()
+	telegramService := serviceManager.All.Telegram
+	if !telegramService.IsLinkOnly(post) {
+		return
+	}
+
+	var incomingURLList []*service.IncomingURL
+	for _, urlString := range telegramService.ExtractURL(post) {
+		incomingURL, ok := serviceManager.MatchURL(urlString)
+		if !ok {
+			return
+		}
+		incomingURLList = append(incomingURLList, incomingURL)
+	}
+
+	// only to record the identities, the admin posted it so duplicates are posted all the same
+	from := submission{ChatID: post.Chat.ID, MessageID: post.MessageID, Submitter: post.AuthorSignature}
+	recorded, _ := extractDuplicate(incomingURLList, from)
+
+	var mediaList []*service.Media
+	for _, incomingURL := range incomingURLList {
+		media, err := serviceManager.ExtractMediaFromIncomingURL(incomingURL)
+		if err == nil && len(media) == 0 {
+			err = errors.New("no media found")
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   incomingURL.URL,
+				"error": err,
+			}).Error("Extract media of channel post failed")
+			for _, incomingURL := range recorded {
+				releaseDuplicate(incomingURL.Identity)
+			}
+			return
+		}
+		mediaList = append(mediaList, media...)
+	}
+
+	chat := channelChat(post.Chat)
+	original := telegramService.HasHashtag(post, "original")
+	for _, media := range mediaList {
+		media.Channel = chat
+		media.SendOriginal = original
+	}
+	result := serviceManager.PostMedia(mediaList)
+	if result.Failed() {
+		for identity, err := range result {
+			if err != nil && identity != "" {
+				releaseDuplicate(identity)
+			}
+		}
+		log.WithFields(log.Fields{
+			"chat":    chat,
+			"message": post.MessageID,
+		}).Warn("Channel post not fully replaced, keep it")
+		return
+	}
+
+	telegramService.DeleteMessages(post.Chat.ID, post.MessageID)
+}
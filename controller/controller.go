@@ -1,15 +1,25 @@
 package controller
 
-import "github.com/wxt2005/image-capture-bot-go/service"
+import (
+	"github.com/wxt2005/image-capture-bot-go/db"
+	"github.com/wxt2005/image-capture-bot-go/service"
+)
 
 type Response struct {
 	Media   *[]*service.Media `json:"media"`
 	Message ResponseMsg       `json:"message"`
 }
 
+type LookupResponse struct {
+	Identity string        `json:"identity"`
+	Record   *db.URLRecord `json:"record"`
+	Message  ResponseMsg   `json:"message"`
+}
+
 type ResponseMsg string
 
 const (
 	MsgSuccess   ResponseMsg = "success"
 	MsgDuplicate ResponseMsg = "duplicate"
+	MsgNotFound  ResponseMsg = "not_found"
 )
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/wxt2005/image-capture-bot-go/db"
+	"github.com/wxt2005/image-capture-bot-go/service"
+)
+
+func isGroup(chat *tgbotapi.Chat) bool {
+	return chat.IsGroup() || chat.IsSuperGroup()
+}
+
+// embedEnabled tells if the group turned on link previews with /embed on
+func embedEnabled(chatID int64) bool {
+	settings, err := db.GetGroupSettings(chatID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"chat":  chatID,
+			"error": err,
+		}).Error("Get group settings failed")
+		return false
+	}
+	return settings.Embed
+}
+
+// handleEmbedCommand runs /embed, /embed on, /embed off and /embed services <service...|all>. Group admins
+// and authed users may change the settings
+func handleEmbedCommand(msg *tgbotapi.Message, lang string) {
+	telegramService := service.GetServiceManager().All.Telegram
+	chatID := msg.Chat.ID
+	args := strings.Fields(strings.ToLower(msg.CommandArguments()))
+
+	settings, err := db.GetGroupSettings(chatID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"chat":  chatID,
+			"error": err,
+		}).Error("Get group settings failed")
+		return
+	}
+
+	if len(args) > 0 && !isUserAuthed(msg.From.ID) && !telegramService.IsChatAdmin(chatID, msg.From.ID) {
+		telegramService.SendNoPremissionMessage(chatID, msg.MessageID, lang)
+		return
+	}
+
+	switch {
+	case len(args) == 0:
+	case args[0] == "on":
+		settings.Embed = true
+	case args[0] == "off":
+		settings.Embed = false
+	case args[0] == "services" && len(args) > 1:
+		var services []string
+		for _, name := range args[1:] {
+			if name == "all" {
+				services = nil
+				break
+			}
+			if !isEmbedService(name) {
+				telegramService.SendText(chatID, msg.MessageID, service.Translate(lang, "embed.unknown_service", name, embedServiceNames()))
+				return
+			}
+			services = append(services, name)
+		}
+		settings.Services = services
+	default:
+		telegramService.SendText(chatID, msg.MessageID, service.Translate(lang, "embed.usage", embedServiceNames()))
+		return
+	}
+
+	if len(args) > 0 {
+		if err := db.PutGroupSettings(chatID, settings); err != nil {
+			log.WithFields(log.Fields{
+				"chat":  chatID,
+				"error": err,
+			}).Error("Save group settings failed")
+			return
+		}
+	}
+
+	state := service.Translate(lang, "embed.off")
+	if settings.Embed {
+		state = service.Translate(lang, "embed.on")
+	}
+	services := strings.Join(settings.Services, ", ")
+	if services == "" {
+		services = service.Translate(lang, "embed.all_services")
+	}
+	telegramService.SendText(chatID, msg.MessageID, service.Translate(lang, "embed.status", state, services))
+}
+
+func isEmbedService(name string) bool {
+	for _, serviceType := range service.EmbedServices {
+		if strings.EqualFold(string(serviceType), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func embedServiceNames() string {
+	var names []string
+	for _, serviceType := range service.EmbedServices {
+		names = append(names, strings.ToLower(string(serviceType)))
+	}
+	return strings.Join(names, ", ")
+}
+
+// handleEmbed replies to a group message with the media of its supported links. Unlike submissions it
+// needs no auth, and skips the channel and the duplicate check
+func handleEmbed(msg *tgbotapi.Message) {
+	serviceManager := service.GetServiceManager()
+	telegramService := serviceManager.All.Telegram
+
+	settings, err := db.GetGroupSettings(msg.Chat.ID)
+	if err != nil || !settings.Embed {
+		return
+	}
+
+	// a message full of links must not turn into as many lookups and extractions
+	urlStringList := telegramService.ExtractURL(msg)
+	if len(urlStringList) > service.EmbedMediaLimit {
+		urlStringList = urlStringList[:service.EmbedMediaLimit]
+	}
+
+	var mediaList []*service.Media
+	for _, urlString := range urlStringList {
+		if len(mediaList) >= service.EmbedMediaLimit {
+			break
+		}
+		incomingURL, ok := serviceManager.MatchURL(urlString)
+		if !ok || !embedsService(settings, incomingURL.Service) {
+			continue
+		}
+
+		media, err := serviceManager.ExtractMediaFromIncomingURL(incomingURL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   urlString,
+				"error": err,
+			}).Info("Extract media for embed failed")
+			continue
+		}
+		mediaList = append(mediaList, media...)
+	}
+	if len(mediaList) > service.EmbedMediaLimit {
+		mediaList = mediaList[:service.EmbedMediaLimit]
+	}
+
+	if len(mediaList) == 0 {
+		return
+	}
+	// media of instance hosted services goes out by url as extracted, see service.EmbedFetches
+	for i, media := range mediaList {
+		if service.EmbedFetches(media) {
+			mediaList[i] = serviceManager.TransformMedia([]*service.Media{media})[0]
+		}
+	}
+	telegramService.EmbedMedia(mediaList, msg.Chat.ID, msg.MessageID)
+}
+
+func embedsService(settings *db.GroupSettings, serviceType service.Type) bool {
+	if len(settings.Services) == 0 {
+		return true
+	}
+	for _, name := range settings.Services {
+		if strings.EqualFold(string(serviceType), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/wxt2005/image-capture-bot-go/db"
+	"github.com/wxt2005/image-capture-bot-go/service"
+	"go.etcd.io/bbolt"
+)
+
+const urlIdentityMigration = "url_identity"
+
+// MigrateURLBucket rewrites url bucket keys from lowercased URLs to content identities. Identities are
+// derived offline and the migration runs once, keys that can't be converted are kept and renamed lazily
+// by extractDuplicate when their link is sent again
+func MigrateURLBucket() {
+	if migrated, err := db.IsMigrated(urlIdentityMigration); err != nil || migrated {
+		return
+	}
+	serviceManager := service.GetServiceManager()
+
+	keys, err := db.LegacyURLKeys()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("List url keys failed")
+		return
+	}
+
+	identities := make(map[string]string)
+	for _, key := range keys {
+		if identity, ok := serviceManager.StoredIdentity(key); ok {
+			identities[key] = identity
+		} else {
+			log.WithField("key", key).Debug("Url key can't be converted offline, keep it")
+		}
+	}
+
+	err = db.DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		for key, identity := range identities {
+			if _, err := db.RenameLegacyURLKey(b, key, identity); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Migrate url bucket failed")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"total":    len(keys),
+		"migrated": len(identities),
+		"kept":     len(keys) - len(identities),
+	}).Info("Migrated url bucket to identities")
+
+	if err := db.SetMigrated(urlIdentityMigration); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Record url bucket migration failed")
+	}
+}
@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/wxt2005/image-capture-bot-go/db"
+	"github.com/wxt2005/image-capture-bot-go/service"
+)
+
+// moderationChatID is where submissions wait for approval, 0 when moderation is off
+func moderationChatID() int64 {
+	return viper.GetInt64("telegram.moderation.chat_id")
+}
+
+// needsModeration is true for submissions made outside the moderator chat while moderation is on
+func needsModeration(from submission) bool {
+	chatID := moderationChatID()
+	return chatID != 0 && from.ChatID != chatID
+}
+
+// submitForModeration saves the media as pending and sends the preview to the moderator chat. Nothing is
+// left pending when the preview can't be sent
+func submitForModeration(mediaList []*service.Media, from submission, lang string) error {
+	telegramService := service.GetServiceManager().All.Telegram
+
+	value, err := service.MarshalMediaList(mediaList)
+	if err != nil {
+		return err
+	}
+
+	item := &db.PendingItem{
+		Media:     value,
+		ChatID:    from.ChatID,
+		MessageID: from.MessageID,
+		Submitter: from.Submitter,
+		Lang:      lang,
+		Created:   time.Now(),
+	}
+	if err := db.PutPendingItem(item); err != nil {
+		return err
+	}
+
+	previewMessageID, err := telegramService.SendModerationPreview(moderationChatID(), mediaList, from.Submitter, item.ID)
+	if err != nil {
+		if _, takeErr := db.TakePendingItem(item.ID); takeErr != nil {
+			log.WithFields(log.Fields{
+				"id":    item.ID,
+				"error": takeErr,
+			}).Error("Delete pending item failed")
+		}
+		releaseIdentities(mediaList)
+		return err
+	}
+	item.PreviewMessageID = previewMessageID
+	return db.PutPendingItem(item)
+}
+
+// deciding holds the pending items a decision is running for, a second click waits for the outcome
+var deciding sync.Map
+
+// handleModerationCallback runs the approve_, reject_ and caption_ buttons of a preview. The item stays
+// pending until the decision is carried out, an approval that failed to post can be tried again
+func handleModerationCallback(query *tgbotapi.CallbackQuery, lang string) {
+	serviceManager := service.GetServiceManager()
+	telegramService := serviceManager.All.Telegram
+	chatID := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+
+	action, idString, _ := strings.Cut(query.Data, "_")
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		return
+	}
+
+	if action != "caption" {
+		if _, busy := deciding.LoadOrStore(id, true); busy {
+			return
+		}
+	}
+	decided := func() {
+		if action != "caption" {
+			deciding.Delete(id)
+		}
+	}
+
+	item, err := db.GetPendingItem(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Error("Get pending item failed")
+		decided()
+		return
+	}
+	if item == nil {
+		telegramService.SendText(chatID, messageID, service.Translate(lang, "moderation.decided"))
+		decided()
+		return
+	}
+
+	mediaList, err := service.UnmarshalMediaList(item.Media)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Error("Read pending media failed")
+		decided()
+		return
+	}
+
+	// takes the item out of pending once the decision is carried out
+	finish := func(decision string, key string) bool {
+		defer decided()
+		if _, err := db.TakePendingItem(id); err != nil {
+			log.WithFields(log.Fields{
+				"id":    id,
+				"error": err,
+			}).Error("Delete pending item failed")
+			return false
+		}
+		telegramService.UpdateModerationPreview(chatID, messageID, mediaList, item.Submitter, item.ID, decision, submitterName(query.From))
+		notifySubmitter(item, mediaList, key)
+		return true
+	}
+
+	switch action {
+	case "approve":
+		position, err := serviceManager.Publish(mediaList, item.Submitter, func(result service.ConsumeResult) {
+			if err := result.RetryErr(); err != nil {
+				log.WithFields(log.Fields{
+					"id":    id,
+					"error": err,
+				}).Error("Post approved media failed")
+				decided()
+				return
+			}
+			finish(service.ModerationApproved, "moderation.notify_approved")
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id":    id,
+				"error": err,
+			}).Error("Publish approved media failed")
+			decided()
+			return
+		}
+		if position > 0 {
+			finish(service.ModerationApproved, "moderation.notify_approved")
+		}
+	case "reject":
+		if finish(service.ModerationRejected, "moderation.notify_rejected") {
+			// a rejected content may be submitted again
+			releaseIdentities(mediaList)
+		}
+	case "caption":
+		promptMessageID, err := telegramService.SendCaptionPrompt(chatID, messageID, lang)
+		if err != nil {
+			return
+		}
+		item.PromptMessageID = promptMessageID
+		if err := db.PutPendingItem(item); err != nil && !errors.Is(err, db.ErrPendingDecided) {
+			log.WithFields(log.Fields{
+				"id":    id,
+				"error": err,
+			}).Error("Save pending item failed")
+		}
+	default:
+		decided()
+	}
+}
+
+// releaseIdentities forgets the identities of media that won't be posted
+func releaseIdentities(mediaList []*service.Media) {
+	released := make(map[string]bool)
+	for _, media := range mediaList {
+		if media.Identity != "" && !released[media.Identity] {
+			released[media.Identity] = true
+			releaseDuplicate(media.Identity)
+		}
+	}
+}
+
+// handleCaptionReply takes a reply to a caption prompt as the new description, false if msg is not one
+func handleCaptionReply(msg *tgbotapi.Message, lang string) bool {
+	if msg.ReplyToMessage == nil || msg.Chat.ID != moderationChatID() {
+		return false
+	}
+
+	item, err := db.FindPendingByPrompt(msg.ReplyToMessage.MessageID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Find pending item failed")
+		return false
+	}
+	if item == nil {
+		return false
+	}
+
+	telegramService := service.GetServiceManager().All.Telegram
+	mediaList, err := service.UnmarshalMediaList(item.Media)
+	if err == nil {
+		service.ReplaceDescription(mediaList, msg.Text)
+		item.Media, err = service.MarshalMediaList(mediaList)
+	}
+	if err == nil {
+		item.PromptMessageID = 0
+		err = db.PutPendingItem(item)
+	}
+
+	if errors.Is(err, db.ErrPendingDecided) {
+		telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "moderation.decided"))
+		return true
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id":    item.ID,
+			"error": err,
+		}).Error("Update pending caption failed")
+		return true
+	}
+
+	telegramService.UpdateModerationPreview(msg.Chat.ID, item.PreviewMessageID, mediaList, item.Submitter, item.ID, "", "")
+	telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "moderation.caption_updated"))
+	return true
+}
+
+// notifySubmitter tells the submitter about the decision, in the chat the links came from
+func notifySubmitter(item *db.PendingItem, mediaList []*service.Media, key string) {
+	if item.ChatID == 0 {
+		return
+	}
+
+	var sources []string
+	seen := make(map[string]bool)
+	for _, media := range mediaList {
+		if media.Source != "" && !seen[media.Source] {
+			seen[media.Source] = true
+			sources = append(sources, media.Source)
+		}
+	}
+
+	telegramService := service.GetServiceManager().All.Telegram
+	telegramService.SendText(item.ChatID, item.MessageID, service.Translate(item.Lang, key, strings.Join(sources, "\n")))
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/wxt2005/image-capture-bot-go/db"
+	"github.com/wxt2005/image-capture-bot-go/service"
+)
+
+// postCommandTarget is what /delete, /recaption and /repost act on: the forwarded post replied to, or
+// every post of a catalog id
+type postCommandTarget struct {
+	Identity string
+	Posts    []db.PostRef
+	// ByReply is set when a single forwarded post was replied to
+	ByReply bool
+}
+
+// resolvePostCommand finds the posts of a command and returns the arguments left after the catalog id
+func resolvePostCommand(msg *tgbotapi.Message) (target postCommandTarget, args string, err error) {
+	args = strings.TrimSpace(msg.CommandArguments())
+
+	if post, ok := service.ForwardedPost(msg.ReplyToMessage); ok {
+		target.Posts = []db.PostRef{post}
+		target.ByReply = true
+		// any message of a post, an original document or slice included, links to its identity
+		link, err := db.FindPostLink(post.ChatID, post.MessageID)
+		if link != nil {
+			target.Identity = link.Identity
+		}
+		return target, args, err
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return target, args, nil
+	}
+	target.Identity = service.CleanIdentity(fields[0])
+	args = strings.TrimSpace(strings.TrimPrefix(args, fields[0]))
+
+	record, err := db.FindURLRecord(target.Identity)
+	if record == nil {
+		target.Identity = ""
+	} else {
+		target.Posts = record.Posts
+	}
+	return target, args, err
+}
+
+// handlePostCommand runs /delete, /recaption <caption> and /repost <channel>
+func handlePostCommand(msg *tgbotapi.Message, lang string) {
+	telegramService := service.GetServiceManager().All.Telegram
+	command := msg.Command()
+
+	target, args, err := resolvePostCommand(msg)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"command": msg.Text,
+			"error":   err,
+		}).Error("Find post failed")
+		return
+	}
+	if len(target.Posts) == 0 && target.Identity == "" {
+		telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "post.not_found"))
+		return
+	}
+	if (command == "recaption" || command == "repost") && args == "" {
+		telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "post.usage"))
+		return
+	}
+
+	done := 0
+	switch command {
+	case "delete":
+		for _, post := range target.Posts {
+			if deletePost(post, target.Identity) == nil {
+				done++
+			}
+		}
+		// a deleted content may be submitted again
+		if !target.ByReply && target.Identity != "" {
+			if err := db.DeleteURLRecord(target.Identity); err != nil {
+				log.WithFields(log.Fields{
+					"identity": target.Identity,
+					"error":    err,
+				}).Error("Delete url record failed")
+			}
+		}
+		telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "post.deleted", done))
+	case "recaption":
+		for _, post := range target.Posts {
+			edited, err := telegramService.EditPostCaption(post, args, countLikes(post.ChatID, postPrimary(post)))
+			if err != nil {
+				continue
+			}
+			done++
+			if target.Identity != "" {
+				db.UpdateURLPost(target.Identity, edited)
+			}
+		}
+		telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "post.recaptioned", done))
+	case "repost":
+		chat := strings.Fields(args)[0]
+		for _, post := range sourcePosts(target.Posts) {
+			if _, err := telegramService.RepostFile(post, chat, target.Identity); err == nil {
+				done++
+			}
+		}
+		telegramService.SendText(msg.Chat.ID, msg.MessageID, service.Translate(lang, "post.reposted", done, chat))
+	}
+}
+
+// postPrimary is the message likes of a post are counted on
+func postPrimary(post db.PostRef) int {
+	if link, _ := db.FindPostLink(post.ChatID, post.MessageID); link != nil {
+		return link.Primary
+	}
+	return post.MessageID
+}
+
+// sourcePosts are the posts in the chat the content was first posted to, each once. Reposts made since
+// are recorded too and are left out
+func sourcePosts(posts []db.PostRef) []db.PostRef {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	var result []db.PostRef
+	seen := make(map[int]bool)
+	for _, post := range posts {
+		if post.ChatID != posts[0].ChatID || seen[post.MessageID] {
+			continue
+		}
+		seen[post.MessageID] = true
+		result = append(result, post)
+	}
+	return result
+}
+
+// deletePost deletes a channel post with every message linked to it, and forgets it
+func deletePost(post db.PostRef, identity string) error {
+	telegramService := service.GetServiceManager().All.Telegram
+
+	messageIDs := []int{post.MessageID}
+	primary := post.MessageID
+	link, err := db.DeletePostLink(post.ChatID, post.MessageID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Delete post link failed")
+	}
+	if link != nil {
+		messageIDs = link.Messages
+		primary = link.Primary
+	}
+
+	// forgotten even if a message is gone already, it was likely deleted by hand
+	if identity != "" {
+		if err := db.RemoveURLPost(identity, post.ChatID, primary); err != nil {
+			log.WithFields(log.Fields{
+				"identity": identity,
+				"error":    err,
+			}).Error("Remove url post failed")
+		}
+	}
+
+	return telegramService.DeleteMessages(post.ChatID, messageIDs...)
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/wxt2005/image-capture-bot-go/db"
+	"github.com/wxt2005/image-capture-bot-go/service"
+)
+
+// handleQueueCommand runs /queue, /queue clear, /queue move <from> <to> and /now [position], each on the
+// queue of the channel given first, e.g. /queue @other clear, or of telegram.channel_name
+func handleQueueCommand(msg *tgbotapi.Message, lang string) {
+	serviceManager := service.GetServiceManager()
+	telegramService := serviceManager.All.Telegram
+	queue := serviceManager.Queue
+	args := strings.Fields(msg.CommandArguments())
+
+	// @username or chat id, positions are never negative
+	channel := ""
+	if len(args) > 0 && (strings.HasPrefix(args[0], "@") || strings.HasPrefix(args[0], "-")) {
+		channel, args = args[0], args[1:]
+	}
+
+	var text string
+	var err error
+	switch {
+	case msg.Command() == "now":
+		position := 1
+		if len(args) > 0 {
+			position, err = strconv.Atoi(args[0])
+			if err != nil {
+				text = service.Translate(lang, "queue.usage")
+				break
+			}
+		}
+		var posted bool
+		posted, err = queue.PostNow(channel, position, serviceManager.PostMedia)
+		if posted {
+			text = service.Translate(lang, "queue.posted", position)
+		} else if err == nil {
+			text = service.Translate(lang, "queue.not_found", position)
+		}
+	case len(args) == 0:
+		text, err = queue.Describe(channel, lang)
+	case args[0] == "clear":
+		var items []db.QueueItem
+		items, err = queue.Clear(channel)
+		// cleared content may be submitted again
+		for _, item := range items {
+			if item.Identity != "" {
+				releaseDuplicate(item.Identity)
+			}
+		}
+		text = service.Translate(lang, "queue.cleared", len(items))
+	case args[0] == "move" && len(args) == 3:
+		from, fromErr := strconv.Atoi(args[1])
+		to, toErr := strconv.Atoi(args[2])
+		if fromErr != nil || toErr != nil {
+			text = service.Translate(lang, "queue.usage")
+			break
+		}
+		err = queue.Move(channel, from, to)
+		if errors.Is(err, db.ErrQueuePosition) {
+			err = nil
+			text = service.Translate(lang, "queue.usage")
+		} else {
+			text = service.Translate(lang, "queue.moved", from, to)
+		}
+	default:
+		text = service.Translate(lang, "queue.usage")
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"command": msg.Text,
+			"error":   err,
+		}).Error("Run queue command failed")
+		return
+	}
+
+	telegramService.SendText(msg.Chat.ID, msg.MessageID, text)
+}
+
+// RunPostQueue posts queued media as it comes due, when telegram.queue.interval is set
+func RunPostQueue() {
+	service.GetServiceManager().RunPostQueue()
+}
@@ -8,6 +8,9 @@ import (
 
 var DB *bbolt.DB
 
+// config keys under db holding the bucket names
+var buckets = []string{"url_bucket", "like_bucket", "auth_bucket", "meta_bucket", "post_bucket", "lang_bucket", "queue_bucket", "pending_bucket", "group_bucket"}
+
 func Init() (*bbolt.DB, error) {
 	db, err := bbolt.Open(viper.GetString("db.db_path"), 0600, nil)
 	if err != nil {
@@ -17,31 +20,15 @@ func Init() (*bbolt.DB, error) {
 
 	// create bucket
 	db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(viper.GetString("db.url_bucket")))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"bucket": "url_bucket",
-			}).Error("Failed to create bucket")
-			mainError = err
-			return err
-		}
-
-		_, err = tx.CreateBucketIfNotExists([]byte(viper.GetString("db.like_bucket")))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"bucket": "like_bucket",
-			}).Error("Failed to create bucket")
-			mainError = err
-			return err
-		}
-
-		_, err = tx.CreateBucketIfNotExists([]byte(viper.GetString("db.auth_bucket")))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"bucket": "auth_bucket",
-			}).Error("Failed to create bucket")
-			mainError = err
-			return err
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(viper.GetString("db." + bucket)))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"bucket": bucket,
+				}).Error("Failed to create bucket")
+				mainError = err
+				return err
+			}
 		}
 
 		return nil
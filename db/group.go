@@ -0,0 +1,45 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+// GroupSettings are the embed settings of a group chat, set with /embed
+type GroupSettings struct {
+	Embed bool `json:"embed"`
+	// Services to expand, lowercased service names, all of them when empty
+	Services []string `json:"services,omitempty"`
+}
+
+func groupKey(chatID int64) []byte {
+	return []byte(fmt.Sprintf("chat_%d", chatID))
+}
+
+// GetGroupSettings returns the settings of a group, zero settings if it never set any
+func GetGroupSettings(chatID int64) (settings *GroupSettings, err error) {
+	settings = &GroupSettings{}
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.group_bucket")))
+		if value := b.Get(groupKey(chatID)); value != nil {
+			return json.Unmarshal(value, settings)
+		}
+		return nil
+	})
+
+	return
+}
+
+func PutGroupSettings(chatID int64, settings *GroupSettings) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.group_bucket")))
+		value, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		return b.Put(groupKey(chatID), value)
+	})
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+// IsMigrated tells if the migration of name finished, finished migrations are recorded in meta bucket
+func IsMigrated(name string) (migrated bool, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket([]byte(viper.GetString("db.meta_bucket")))
+		migrated = meta.Get([]byte("migration_"+name)) != nil
+		return nil
+	})
+
+	return
+}
+
+// SetMigrated records the migration of name as finished
+func SetMigrated(name string) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket([]byte(viper.GetString("db.meta_bucket")))
+		return meta.Put([]byte("migration_"+name), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
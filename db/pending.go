@@ -0,0 +1,104 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+// PendingItem is a submission waiting for a moderator, Media is the media list as the service package
+// marshals it
+type PendingItem struct {
+	ID    uint64          `json:"id"`
+	Media json.RawMessage `json:"media"`
+	// where the submission came from, ChatID is 0 for the API
+	ChatID    int64  `json:"chat_id"`
+	MessageID int    `json:"message_id"`
+	Submitter string `json:"submitter,omitempty"`
+	Lang      string `json:"lang,omitempty"`
+	// the preview in the moderator chat, and the prompt asking for a new caption if any
+	PreviewMessageID int       `json:"preview_message_id"`
+	PromptMessageID  int       `json:"prompt_message_id,omitempty"`
+	Created          time.Time `json:"created"`
+}
+
+var ErrPendingDecided = errors.New("pending item already decided")
+
+func pendingKey(id uint64) []byte {
+	return []byte(strconv.FormatUint(id, 10))
+}
+
+// PutPendingItem saves the item, giving it an id if it has none. An item taken in the meantime is not
+// saved again, ErrPendingDecided is returned instead
+func PutPendingItem(item *PendingItem) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.pending_bucket")))
+		if item.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			item.ID = id
+		} else if b.Get(pendingKey(item.ID)) == nil {
+			return ErrPendingDecided
+		}
+
+		value, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return b.Put(pendingKey(item.ID), value)
+	})
+}
+
+func GetPendingItem(id uint64) (item *PendingItem, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.pending_bucket")))
+		value := b.Get(pendingKey(id))
+		if value == nil {
+			return nil
+		}
+		item = &PendingItem{}
+		return json.Unmarshal(value, item)
+	})
+
+	return
+}
+
+// TakePendingItem removes the item and returns it, nil if it was already decided
+func TakePendingItem(id uint64) (item *PendingItem, err error) {
+	err = DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.pending_bucket")))
+		value := b.Get(pendingKey(id))
+		if value == nil {
+			return nil
+		}
+		item = &PendingItem{}
+		if err := json.Unmarshal(value, item); err != nil {
+			return err
+		}
+		return b.Delete(pendingKey(id))
+	})
+
+	return
+}
+
+// FindPendingByPrompt finds the item a caption prompt message was sent for
+func FindPendingByPrompt(messageID int) (item *PendingItem, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.pending_bucket")))
+		return b.ForEach(func(k, v []byte) error {
+			pending := PendingItem{}
+			if json.Unmarshal(v, &pending) == nil && pending.PromptMessageID == messageID {
+				item = &pending
+			}
+			return nil
+		})
+	})
+
+	return
+}
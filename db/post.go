@@ -0,0 +1,129 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+// PostLink ties together the Telegram messages of one post, e.g. a photo and its original document.
+// It is stored under every message of the post, so any of them leads to the others
+type PostLink struct {
+	Identity string `json:"identity,omitempty"`
+	ChatID   int64  `json:"chat_id"`
+	// Primary is the message likes are counted on
+	Primary  int   `json:"primary"`
+	Messages []int `json:"messages"`
+	// Buttons are the messages carrying the like button, albums can't have one
+	Buttons []int `json:"buttons"`
+	// Album are the photos of a post sent as albums, in order, to post them again
+	Album []PostRef `json:"album,omitempty"`
+}
+
+func postKey(chatID int64, messageID int) []byte {
+	return []byte(fmt.Sprintf("chat_%d_msg_%d", chatID, messageID))
+}
+
+func getPostLink(b *bbolt.Bucket, chatID int64, messageID int) *PostLink {
+	value := b.Get(postKey(chatID, messageID))
+	if value == nil {
+		return nil
+	}
+
+	link := PostLink{}
+	if err := json.Unmarshal(value, &link); err != nil {
+		return nil
+	}
+
+	return &link
+}
+
+// LinkPostMessages adds messages to the post of primary, creating the link if needed
+func LinkPostMessages(chatID int64, primary int, identity string, withButton bool, messageIDs ...int) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.post_bucket")))
+		link := getPostLink(b, chatID, primary)
+		if link == nil {
+			link = &PostLink{Identity: identity, ChatID: chatID, Primary: primary, Messages: []int{primary}, Buttons: []int{primary}}
+		}
+
+		for _, messageID := range messageIDs {
+			link.Messages = appendMissing(link.Messages, messageID)
+			if withButton {
+				link.Buttons = appendMissing(link.Buttons, messageID)
+			}
+		}
+
+		return putPostLink(b, link)
+	})
+}
+
+// SetPostAlbum records the album photos of the post of primary
+func SetPostAlbum(chatID int64, primary int, album []PostRef) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.post_bucket")))
+		link := getPostLink(b, chatID, primary)
+		if link == nil {
+			return nil
+		}
+
+		link.Album = album
+		return putPostLink(b, link)
+	})
+}
+
+// putPostLink stores the link under every message of the post
+func putPostLink(b *bbolt.Bucket, link *PostLink) error {
+	value, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	for _, messageID := range link.Messages {
+		if err := b.Put(postKey(link.ChatID, messageID), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendMissing(list []int, value int) []int {
+	for _, item := range list {
+		if item == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// FindPostLink looks up the post a message belongs to, nil if it was posted alone
+func FindPostLink(chatID int64, messageID int) (link *PostLink, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.post_bucket")))
+		link = getPostLink(b, chatID, messageID)
+		return nil
+	})
+
+	return
+}
+
+// DeletePostLink drops the link of the post a message belongs to from every message of it, returning it
+func DeletePostLink(chatID int64, messageID int) (link *PostLink, err error) {
+	err = DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.post_bucket")))
+		link = getPostLink(b, chatID, messageID)
+		if link == nil {
+			return nil
+		}
+		for _, id := range link.Messages {
+			if err := b.Delete(postKey(chatID, id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+// QueueItem is a content waiting to be posted, Media is the media list as the service package marshals it
+type QueueItem struct {
+	ID        uint64          `json:"id"`
+	Identity  string          `json:"identity,omitempty"`
+	Media     json.RawMessage `json:"media"`
+	Submitter string          `json:"submitter,omitempty"`
+	Added     time.Time       `json:"added"`
+	// Attempts counts the failed posts of the item
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// ChannelQueue is the posting queue of a channel, in posting order
+type ChannelQueue struct {
+	Items      []QueueItem `json:"items"`
+	LastPosted time.Time   `json:"last_posted"`
+}
+
+var ErrQueuePosition = errors.New("queue position out of range")
+
+const queueKeyPrefix = "queue_"
+
+func queueKey(channel string) []byte {
+	return []byte(queueKeyPrefix + channel)
+}
+
+func getChannelQueue(b *bbolt.Bucket, channel string) (*ChannelQueue, error) {
+	queue := ChannelQueue{}
+	if value := b.Get(queueKey(channel)); value != nil {
+		if err := json.Unmarshal(value, &queue); err != nil {
+			return nil, err
+		}
+	}
+	return &queue, nil
+}
+
+func putChannelQueue(b *bbolt.Bucket, channel string, queue *ChannelQueue) error {
+	value, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	return b.Put(queueKey(channel), value)
+}
+
+// updateChannelQueue runs fn on the queue of channel and saves it unless fn fails
+func updateChannelQueue(channel string, fn func(b *bbolt.Bucket, queue *ChannelQueue) error) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.queue_bucket")))
+		queue, err := getChannelQueue(b, channel)
+		if err != nil {
+			return err
+		}
+		if err := fn(b, queue); err != nil {
+			return err
+		}
+		return putChannelQueue(b, channel, queue)
+	})
+}
+
+func GetChannelQueue(channel string) (queue *ChannelQueue, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.queue_bucket")))
+		queue, err = getChannelQueue(b, channel)
+		return err
+	})
+
+	return
+}
+
+// QueueChannels lists the channels that have a queue stored, empty or not
+func QueueChannels() (channels []string, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(viper.GetString("db.queue_bucket"))).Cursor()
+		prefix := []byte(queueKeyPrefix)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			channels = append(channels, string(k[len(prefix):]))
+		}
+		return nil
+	})
+
+	return
+}
+
+// PushQueueItem appends an item to the queue of channel, returns its position counted from 1
+func PushQueueItem(channel string, item QueueItem) (position int, err error) {
+	err = updateChannelQueue(channel, func(b *bbolt.Bucket, queue *ChannelQueue) error {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		item.ID = id
+		queue.Items = append(queue.Items, item)
+		position = len(queue.Items)
+		return nil
+	})
+
+	return
+}
+
+// GetQueueItem reads the item at position, nil if the queue is shorter
+func GetQueueItem(channel string, position int) (*QueueItem, error) {
+	queue, err := GetChannelQueue(channel)
+	if err != nil || position < 1 || position > len(queue.Items) {
+		return nil, err
+	}
+
+	item := queue.Items[position-1]
+	return &item, nil
+}
+
+// RemoveQueueItem takes a posted item out of the queue by id, marking the channel as just posted
+func RemoveQueueItem(channel string, id uint64, now time.Time) error {
+	return updateChannelQueue(channel, func(b *bbolt.Bucket, queue *ChannelQueue) error {
+		for i, item := range queue.Items {
+			if item.ID == id {
+				queue.Items = append(queue.Items[:i], queue.Items[i+1:]...)
+				break
+			}
+		}
+		queue.LastPosted = now
+		return nil
+	})
+}
+
+// FailQueueItem counts a failed post of an item, which stays in place. The channel is marked as just
+// posted so the item is tried again an interval later. Returns the failed attempts so far
+func FailQueueItem(channel string, id uint64, now time.Time) (attempts int, err error) {
+	err = updateChannelQueue(channel, func(b *bbolt.Bucket, queue *ChannelQueue) error {
+		for i := range queue.Items {
+			if queue.Items[i].ID == id {
+				queue.Items[i].Attempts++
+				attempts = queue.Items[i].Attempts
+				break
+			}
+		}
+		queue.LastPosted = now
+		return nil
+	})
+
+	return
+}
+
+// ClearQueue drops every item of the queue and returns them
+func ClearQueue(channel string) (items []QueueItem, err error) {
+	err = updateChannelQueue(channel, func(b *bbolt.Bucket, queue *ChannelQueue) error {
+		items = queue.Items
+		queue.Items = nil
+		return nil
+	})
+
+	return
+}
+
+// MoveQueueItem moves the item at position from to position to, both counted from 1
+func MoveQueueItem(channel string, from int, to int) error {
+	return updateChannelQueue(channel, func(b *bbolt.Bucket, queue *ChannelQueue) error {
+		if from < 1 || from > len(queue.Items) || to < 1 || to > len(queue.Items) {
+			return ErrQueuePosition
+		}
+		item := queue.Items[from-1]
+		items := append(queue.Items[:from-1:from-1], queue.Items[from:]...)
+		items = append(items[:to-1], append([]QueueItem{item}, items[to-1:]...)...)
+		queue.Items = items
+		return nil
+	})
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+// URLRecord is the value stored in url bucket, keyed by the content identity
+type URLRecord struct {
+	Identity  string    `json:"identity"`
+	URL       string    `json:"url"`
+	FirstSeen time.Time `json:"first_seen"`
+	ChatID    int64     `json:"chat_id,omitempty"`
+	MessageID int       `json:"message_id,omitempty"`
+	UserID    int64     `json:"user_id,omitempty"`
+	Submitter string    `json:"submitter,omitempty"`
+	// Posts are the Telegram messages the content was posted as
+	Posts []PostRef `json:"posts,omitempty"`
+}
+
+// PostRef points to a Telegram message holding a post
+type PostRef struct {
+	ChatID       int64     `json:"chat_id"`
+	ChatUserName string    `json:"chat_username,omitempty"`
+	MessageID    int       `json:"message_id"`
+	Date         time.Time `json:"date"`
+	// the posted file and caption, to post it again without the source. Entities are as Telegram sends them
+	FileID          string          `json:"file_id,omitempty"`
+	FileType        string          `json:"file_type,omitempty"`
+	Caption         string          `json:"caption,omitempty"`
+	CaptionEntities json.RawMessage `json:"caption_entities,omitempty"`
+}
+
+// Link returns the t.me link of the message
+func (p PostRef) Link() string {
+	if p.ChatUserName != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", p.ChatUserName, p.MessageID)
+	}
+	// private channel, ids look like -1001234567890 and links use 1234567890
+	return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(strconv.FormatInt(p.ChatID, 10), "-100"), p.MessageID)
+}
+
+// GetURLRecord reads the record of an identity from url bucket, nil if never seen
+func GetURLRecord(b *bbolt.Bucket, identity string) *URLRecord {
+	value := b.Get([]byte(identity))
+	if value == nil {
+		return nil
+	}
+
+	record := URLRecord{}
+	// records written before identities were introduced only hold "1"
+	if err := json.Unmarshal(value, &record); err != nil {
+		return &URLRecord{Identity: identity}
+	}
+
+	return &record
+}
+
+func PutURLRecord(b *bbolt.Bucket, record *URLRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(record.Identity), value)
+}
+
+// FindURLRecord looks up when and where an identity was first seen
+func FindURLRecord(identity string) (record *URLRecord, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		record = GetURLRecord(b, identity)
+		return nil
+	})
+
+	return
+}
+
+// ReleaseURLRecord forgets an identity that was not posted, so it may be submitted again. Identities
+// posted before are kept
+func ReleaseURLRecord(identity string) error {
+	return DB.Batch(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		if record := GetURLRecord(b, identity); record != nil && len(record.Posts) == 0 {
+			return b.Delete([]byte(identity))
+		}
+		return nil
+	})
+}
+
+// LegacyURLKeys lists the url bucket keys still holding a lowercased url instead of an identity
+func LegacyURLKeys() (keys []string, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		return b.ForEach(func(k, v []byte) error {
+			if strings.Contains(string(k), "://") {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+	})
+
+	return
+}
+
+// RenameLegacyURLKey moves the record of a lowercased url key to an identity, unless the identity
+// has a record already. It reports if the key was there
+func RenameLegacyURLKey(b *bbolt.Bucket, key string, identity string) (bool, error) {
+	record := GetURLRecord(b, key)
+	if record == nil {
+		return false, nil
+	}
+
+	if GetURLRecord(b, identity) == nil {
+		record.Identity = identity
+		if record.URL == "" {
+			record.URL = key
+		}
+		if err := PutURLRecord(b, record); err != nil {
+			return true, err
+		}
+	}
+
+	return true, b.Delete([]byte(key))
+}
+
+// AddURLPost records a Telegram message holding the content of an identity
+func AddURLPost(identity string, post PostRef) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		record := GetURLRecord(b, identity)
+		// content sent with force skips the dedup check and has no record yet
+		if record == nil {
+			record = &URLRecord{Identity: identity, FirstSeen: post.Date}
+		}
+		record.Posts = append(record.Posts, post)
+		return PutURLRecord(b, record)
+	})
+}
+
+// UpdateURLPost replaces the recorded post of an identity that points to the same message
+func UpdateURLPost(identity string, post PostRef) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		record := GetURLRecord(b, identity)
+		if record == nil {
+			return nil
+		}
+		for i, existing := range record.Posts {
+			if existing.ChatID == post.ChatID && existing.MessageID == post.MessageID {
+				record.Posts[i] = post
+			}
+		}
+		return PutURLRecord(b, record)
+	})
+}
+
+// RemoveURLPost forgets a deleted post of an identity. Without posts left the record goes too, so the
+// content is no longer a duplicate
+func RemoveURLPost(identity string, chatID int64, messageID int) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		record := GetURLRecord(b, identity)
+		if record == nil {
+			return nil
+		}
+
+		var posts []PostRef
+		for _, post := range record.Posts {
+			if post.ChatID != chatID || post.MessageID != messageID {
+				posts = append(posts, post)
+			}
+		}
+		if len(posts) == 0 {
+			return b.Delete([]byte(identity))
+		}
+		record.Posts = posts
+		return PutURLRecord(b, record)
+	})
+}
+
+// DeleteURLRecord forgets an identity, it is no longer a duplicate
+func DeleteURLRecord(identity string) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.url_bucket")))
+		return b.Delete([]byte(identity))
+	})
+}
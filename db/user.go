@@ -0,0 +1,30 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.etcd.io/bbolt"
+)
+
+func userKey(userID int64) []byte {
+	return []byte(fmt.Sprintf("user_%d", userID))
+}
+
+// GetUserLanguage returns the language the user picked with /lang, empty if none
+func GetUserLanguage(userID int64) (lang string, err error) {
+	err = DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.lang_bucket")))
+		lang = string(b.Get(userKey(userID)))
+		return nil
+	})
+
+	return
+}
+
+func SetUserLanguage(userID int64, lang string) error {
+	return DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(viper.GetString("db.lang_bucket")))
+		return b.Put(userKey(userID), []byte(lang))
+	})
+}
@@ -31,6 +31,7 @@ type GetIllustRankingIllust struct {
 	Width          int                              `json:"width"`
 	Height         int                              `json:"height"`
 	SanityLevel    int                              `json:"sanity_level"`
+	XRestrict      int                              `json:"x_restrict"`
 	Series         GetIllustRankingIllustSeries     `json:"series"`
 	MetaSinglePage map[string]string                `json:"meta_single_page"`
 	MetaPages      []GetIllustRankingIllustMetaPage `json:"meta_pages"`
@@ -81,6 +82,7 @@ type GetIllustDetailIllust struct {
 	Width          int                             `json:"width"`
 	Height         int                             `json:"height"`
 	SanityLevel    int                             `json:"sanity_level"`
+	XRestrict      int                             `json:"x_restrict"`
 	Series         GetIllustDetailIllustSeries     `json:"series"`
 	MetaSinglePage map[string]string               `json:"meta_single_page"`
 	MetaPages      []GetIllustDetailIllustMetaPage `json:"meta_pages"`
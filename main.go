@@ -21,6 +21,7 @@ func init() {
 	}
 
 	// init viper
+	setDefaults()
 	viper.SetConfigType("yaml")
 	viper.SetConfigName("config")
 	viper.AddConfigPath("./external")
@@ -40,6 +41,29 @@ func init() {
 	}
 }
 
+// setDefaults fills config keys added after the first release, so old config files keep working
+func setDefaults() {
+	viper.SetDefault("db.meta_bucket", "meta")
+	viper.SetDefault("db.post_bucket", "post")
+	viper.SetDefault("db.lang_bucket", "lang")
+	viper.SetDefault("db.queue_bucket", "queue")
+	viper.SetDefault("db.pending_bucket", "pending")
+	viper.SetDefault("db.group_bucket", "group")
+	viper.SetDefault("telegram.slice_ratio", 3)
+	viper.SetDefault("telegram.slice_overlap", 100)
+	viper.SetDefault("telegram.original_enabled", false)
+	viper.SetDefault("telegram.original_mode", "reply")
+	viper.SetDefault("s3.keep_original", true)
+	viper.SetDefault("dropbox.keep_original", true)
+	viper.SetDefault("telegram.sensitive_policy", "blur")
+	viper.SetDefault("telegram.caption.overflow", "cut")
+	viper.SetDefault("telegram.language", "zh")
+	viper.SetDefault("telegram.rate.private_interval", "1s")
+	viper.SetDefault("telegram.rate.group_interval", "3s")
+	viper.SetDefault("telegram.rate.global_per_second", 30)
+	viper.SetDefault("telegram.queue.interval", "0s")
+}
+
 func main() {
 	// get PORT from env, use with PORT=8080 or some
 	port := os.Getenv("PORT")
@@ -54,6 +78,11 @@ func main() {
 
 	http.HandleFunc("/api/"+viper.GetString("telegram.bot_token")+"/message", controller.MessageHandler)
 	http.HandleFunc("/api/send", controller.APIHandler)
+	http.HandleFunc("/api/lookup", controller.LookupHandler)
+
+	controller.MigrateURLBucket()
+	go controller.SeedChatAliases()
+	go controller.RunPostQueue()
 
 	log.WithFields(log.Fields{
 		"port": port,
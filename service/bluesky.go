@@ -3,14 +3,22 @@ package service
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/xrpc"
 	log "github.com/sirupsen/logrus"
 )
 
+// handle -> DID, handles are only resolved once per process
+var blueskyDIDCache sync.Map
+
+// Self labels and moderation labels that hide media behind a warning in the bluesky app
+var blueskySensitiveLabels = map[string]bool{"porn": true, "sexual": true, "nudity": true, "graphic-media": true, "gore": true}
+
 type BlueskyService struct {
 	Service   Type
 	urlRegexp *regexp.Regexp
@@ -52,6 +60,32 @@ func (s BlueskyService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
+// StoredIdentity needs the DID in the url, resolving a handle takes a network call
+func (s BlueskyService) StoredIdentity(incomingURL *IncomingURL) (string, bool) {
+	if !strings.HasPrefix(incomingURL.Host, "did:") {
+		return "", false
+	}
+	return s.Identity(incomingURL), true
+}
+
+// Identity uses the DID instead of the handle, handles can be changed at any time
+func (s BlueskyService) Identity(incomingURL *IncomingURL) string {
+	did := incomingURL.Host
+	if !strings.HasPrefix(did, "did:") {
+		if cached, ok := blueskyDIDCache.Load(did); ok {
+			did = cached.(string)
+		} else if resolvedDid, err := s.resolveHandle(context.Background(), did); err == nil {
+			blueskyDIDCache.Store(incomingURL.Host, resolvedDid)
+			did = resolvedDid
+		} else {
+			log.WithError(err).Warn("Failed to resolve Bluesky handle, use it as identity")
+			did = strings.ToLower(did)
+		}
+	}
+
+	return fmt.Sprintf("bluesky:%s/%s", did, incomingURL.StrID)
+}
+
 func (s BlueskyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error) {
 	var result []*Media
 	ctx := context.Background()
@@ -100,8 +134,10 @@ func (s BlueskyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 
 	// Extract description/text
 	var description string
+	var richDescription RichText
 	if postRecord, ok := post.Record.Val.(*bsky.FeedPost); ok {
 		description = postRecord.Text
+		richDescription = blueskyRichText(postRecord)
 	}
 
 	// Extract media from embed
@@ -135,9 +171,48 @@ func (s BlueskyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 		}
 	}
 
+	sensitive := false
+	for _, label := range post.Labels {
+		if blueskySensitiveLabels[label.Val] {
+			sensitive = true
+			break
+		}
+	}
+	for _, media := range result {
+		media.Sensitive = sensitive
+		setDescription(media, richDescription)
+	}
+
 	return result, nil
 }
 
+// blueskyRichText resolves the facets of a post, mentions link to the profile and tags to the hashtag page
+func blueskyRichText(post *bsky.FeedPost) RichText {
+	var ranges []textRange
+	for _, facet := range post.Facets {
+		if facet.Index == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			r := textRange{start: int(facet.Index.ByteStart), end: int(facet.Index.ByteEnd)}
+			switch {
+			case feature.RichtextFacet_Link != nil:
+				r.url = feature.RichtextFacet_Link.Uri
+			case feature.RichtextFacet_Mention != nil:
+				r.url = "https://bsky.app/profile/" + feature.RichtextFacet_Mention.Did
+			case feature.RichtextFacet_Tag != nil:
+				r.url = "https://bsky.app/hashtag/" + url.PathEscape(feature.RichtextFacet_Tag.Tag)
+			default:
+				continue
+			}
+			ranges = append(ranges, r)
+			break
+		}
+	}
+
+	return richTextFromRanges(post.Text, ranges)
+}
+
 func (s BlueskyService) resolveHandle(ctx context.Context, handle string) (string, error) {
 	output, err := bsky.ActorGetProfile(ctx, s.client, handle)
 	if err != nil {
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Telegram captions hold 1024 characters after markup is parsed, text messages 4096
+const telegramCaptionLimit = 1024
+const telegramMessageLimit = 4096
+
+// What happens to a description that doesn't fit: cut with a link to the source, or continued in a reply
+const (
+	CaptionOverflowCut      = "cut"
+	CaptionOverflowFollowUp = "followup"
+)
+
+// defaultCaptionTemplate renders MarkdownV2, every value goes through escape
+const defaultCaptionTemplate = `{{if .Title}}*{{escape .Title}}*
+{{end}}{{if .ContentWarning}}CW: {{escape .ContentWarning}}
+{{end}}{{if .Description}}{{if .ContentWarning}}||{{.DescriptionMarkdown}}||{{else}}{{.DescriptionMarkdown}}{{end}}{{if and .Truncated .Source}} [{{t .Lang "caption.more"}}]({{link .Source}}){{end}}
+{{end}}{{if .Author}}{{t .Lang "caption.author"}}: {{if .AuthorURL}}[{{escape .Author}}]({{link .AuthorURL}}){{else}}{{escape .Author}}{{end}}
+{{else}}
+{{end}}{{if .Source}}{{t .Lang "caption.source"}}: [{{escape .Service}}]({{link .Source}})
+{{end}}{{if .Tags}}{{hashtags .Tags}}
+{{end}}`
+
+// captionData is what templates see, every Media field plus the truncation state
+type captionData struct {
+	*Media
+	// Truncated is set when Description was cut to fit
+	Truncated bool
+	// Lang is the language of the channel, for the t helper
+	Lang string
+}
+
+// DescriptionMarkdown is the description in MarkdownV2, with the links of the rich description
+func (d captionData) DescriptionMarkdown() string {
+	if d.RichDescription != nil {
+		return d.RichDescription.Markdown()
+	}
+	return escape(d.Description)
+}
+
+var captionFuncs = template.FuncMap{
+	"escape":   escape,
+	"link":     escapeLink,
+	"hashtags": hashtags,
+	"t":        translateCaption,
+}
+
+// sourceCaptionTemplate is the last resort for templates too long even without description and tags
+var sourceCaptionTemplate = template.Must(template.New("source").Funcs(captionFuncs).Parse(`{{if .Source}}{{t .Lang "caption.source"}}: [{{escape .Service}}]({{link .Source}}){{end}}`))
+
+// CaptionRenderer renders captions from text/template templates, picked by channel and service
+type CaptionRenderer struct {
+	templates map[string]*template.Template
+	fallback  *template.Template
+	overflow  string
+	language  string
+}
+
+// NewCaptionRenderer reads telegram.caption.templates, keyed by "<channel>/<service>", "<channel>",
+// "<service>" or "default", most specific first
+func NewCaptionRenderer() *CaptionRenderer {
+	renderer := &CaptionRenderer{
+		templates: make(map[string]*template.Template),
+		fallback:  template.Must(template.New("builtin").Funcs(captionFuncs).Parse(defaultCaptionTemplate)),
+		overflow:  viper.GetString("telegram.caption.overflow"),
+		language:  defaultLanguage(),
+	}
+
+	for key, text := range viper.GetStringMapString("telegram.caption.templates") {
+		tmpl, err := template.New(key).Funcs(captionFuncs).Parse(text)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"template": key,
+				"error":    err,
+			}).Error("Parse caption template failed")
+			continue
+		}
+		renderer.templates[strings.ToLower(key)] = tmpl
+	}
+
+	return renderer
+}
+
+func (r *CaptionRenderer) template(chat string, service string) *template.Template {
+	chat = strings.ToLower(chat)
+	service = strings.ToLower(service)
+	for _, key := range []string{chat + "/" + service, chat, service, "default"} {
+		if tmpl, ok := r.templates[key]; ok {
+			return tmpl
+		}
+	}
+	return r.fallback
+}
+
+// Render returns the caption of the media in chat. When the description doesn't fit, it is cut at a
+// length where the whole caption does, and in followup mode the rest is returned as overflow
+func (r *CaptionRenderer) Render(media *Media, chat string) (caption string, overflow RichText) {
+	tmpl := r.template(chat, media.Service)
+
+	caption = r.execute(tmpl, media, false)
+	if captionLength(caption) <= telegramCaptionLimit {
+		return caption, nil
+	}
+
+	description := media.RichDescription
+	if description == nil {
+		description = RichText{{Text: media.Description}}
+	}
+
+	// find the longest description that fits, the markup around it stays intact
+	low, high := 0, description.Len()
+	best := -1
+	for low <= high {
+		mid := (low + high) / 2
+		if captionLength(r.executeCut(tmpl, media, description.Slice(0, mid))) <= telegramCaptionLimit {
+			best = mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+
+	if best < 0 {
+		// too long even without description, drop the tags as well
+		trimmed := *media
+		trimmed.Description = ""
+		trimmed.RichDescription = nil
+		trimmed.Tags = nil
+		caption = r.execute(tmpl, &trimmed, description.Len() > 0)
+		if captionLength(caption) > telegramCaptionLimit {
+			caption = r.execute(sourceCaptionTemplate, media, false)
+		}
+		best = 0
+	} else {
+		caption = r.executeCut(tmpl, media, description.Slice(0, best))
+	}
+
+	if r.overflow == CaptionOverflowFollowUp {
+		overflow = description.Slice(best, description.Len()).TrimSpace()
+	}
+
+	return caption, overflow
+}
+
+func (r *CaptionRenderer) executeCut(tmpl *template.Template, media *Media, description RichText) string {
+	cut := *media
+	cut.RichDescription = append(description.TrimSpace(), RichSpan{Text: "…"})
+	cut.Description = cut.RichDescription.String()
+	// the source link points to the rest, a follow-up reply carries it instead
+	return r.execute(tmpl, &cut, r.overflow != CaptionOverflowFollowUp)
+}
+
+func (r *CaptionRenderer) execute(tmpl *template.Template, media *Media, truncated bool) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, captionData{Media: media, Truncated: truncated, Lang: r.language}); err != nil {
+		log.WithFields(log.Fields{
+			"template": tmpl.Name(),
+			"error":    err,
+		}).Error("Render caption failed")
+		if tmpl != r.fallback {
+			return r.execute(r.fallback, media, truncated)
+		}
+	}
+	return buf.String()
+}
+
+// captionLength counts a MarkdownV2 caption as Telegram does, in UTF-16 units after the markup is parsed
+func captionLength(markdown string) int {
+	length := 0
+	runes := []rune(markdown)
+	inURL := false
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == '\\' && i+1 < len(runes) {
+			i++
+			if !inURL {
+				length += len(utf16.Encode([]rune{runes[i]}))
+			}
+			continue
+		}
+		if inURL {
+			inURL = r != ')'
+			continue
+		}
+		switch r {
+		case '*', '_', '~', '|', '`', '[':
+			continue
+		case ']':
+			if i+1 < len(runes) && runes[i+1] == '(' {
+				inURL = true
+				i++
+			}
+			continue
+		}
+		length += len(utf16.Encode([]rune{r}))
+	}
+	return length
+}
+
+// translateCaption is Translate escaped for MarkdownV2
+func translateCaption(lang string, key string, args ...interface{}) string {
+	return escape(Translate(lang, key, args...))
+}
+
+// Telegram hashtags end at the first space or punctuation
+var hashtagReplacer = strings.NewReplacer(" ", "_", "-", "_", ".", "_", "/", "_", "'", "", "&", "_")
+
+func hashtags(tags []string) string {
+	var result []string
+	for _, tag := range tags {
+		result = append(result, escape("#"+hashtagReplacer.Replace(tag)))
+	}
+	return strings.Join(result, " ")
+}
+
+// escape makes plain text safe in MarkdownV2, markup of the origin is parsed by providers into RichText
+var escapeRe = regexp.MustCompile("(\\\\|\\.|_|\\*|\\[|\\]|\\(|\\)|\\~|>|#|\\+|-|=|\\||\\{|\\}|!|`)")
+
+func escape(origin string) string {
+	return escapeRe.ReplaceAllString(origin, `\$1`)
+}
+
+// escapeLink escapes the url part of a MarkdownV2 link
+var linkEscaper = strings.NewReplacer(`\`, `\\`, `)`, `\)`)
+
+func escapeLink(url string) string {
+	return linkEscaper.Replace(url)
+}
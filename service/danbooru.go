@@ -13,6 +13,9 @@ import (
 	"github.com/spf13/viper"
 )
 
+// Ratings blurred on danbooru itself, s is only mildly suggestive
+var danbooruSensitiveRatings = map[string]bool{"q": true, "e": true}
+
 type DanbooruService struct {
 	Service   Type
 	urlRegexp *regexp.Regexp
@@ -50,6 +53,10 @@ func (s DanbooruService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
+func (s DanbooruService) Identity(incomingURL *IncomingURL) string {
+	return "danbooru:" + incomingURL.StrID
+}
+
 func (s DanbooruService) ExtractMediaFromURL(incomingURL *IncomingURL) (result []*Media, err error) {
 	manager := GetServiceManager()
 
@@ -82,6 +89,8 @@ func (s DanbooruService) ExtractMediaFromURL(incomingURL *IncomingURL) (result [
 		Source  string
 		FileURL string `json:"file_url"`
 		PixivID int    `json:"pixiv_id"`
+		// g(eneral), s(ensitive), q(uestionable) or e(xplicit)
+		Rating string
 	}{}
 	if err := json.Unmarshal(body, &m); err != nil {
 		log.WithFields(log.Fields{
@@ -100,6 +109,10 @@ func (s DanbooruService) ExtractMediaFromURL(incomingURL *IncomingURL) (result [
 		for _, provider := range sourceServices {
 			if incomingURL, ok := provider.CheckValid(m.Source); ok {
 				if media, err := provider.ExtractMediaFromURL(incomingURL); err == nil && len(media) > 0 {
+					// the rating of the post counts even when the source doesn't flag it
+					for _, item := range media {
+						item.Sensitive = item.Sensitive || danbooruSensitiveRatings[m.Rating]
+					}
 					result = append(result, media...)
 					return result, nil
 				}
@@ -110,11 +123,12 @@ func (s DanbooruService) ExtractMediaFromURL(incomingURL *IncomingURL) (result [
 	urlParts := strings.Split(m.FileURL, "/")
 	fileName := urlParts[len(urlParts)-1]
 	media := Media{
-		FileName: fileName,
-		URL:      m.FileURL,
-		Type:     "photo",
-		Source:   incomingURL.URL,
-		Service:  string(s.Service),
+		FileName:  fileName,
+		URL:       m.FileURL,
+		Type:      "photo",
+		Source:    incomingURL.URL,
+		Service:   string(s.Service),
+		Sensitive: danbooruSensitiveRatings[m.Rating],
 	}
 	result = append(result, &media)
 
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Files larger than this are not worth downloading, nothing can shrink them enough for Telegram
+const downloadLimit = 200 * 1024 * 1024
+
+// media urls come from whatever instance a post lives on, so they must not lead to our own network
+var downloadClient = newPublicClient(5 * time.Minute)
+
+// downloadMedia fetches media.URL, sending a referer so hotlink protected hosts let us in
+func downloadMedia(media *Media) ([]byte, error) {
+	req, err := http.NewRequest("GET", media.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/111.0.0.0 Safari/537.36")
+	if referer := downloadReferer(media); referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed with status %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > downloadLimit {
+		return nil, fmt.Errorf("file too large: %d bytes", resp.ContentLength)
+	}
+
+	file, err := io.ReadAll(io.LimitReader(resp.Body, downloadLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(file) > downloadLimit {
+		return nil, fmt.Errorf("file too large: more than %d bytes", downloadLimit)
+	}
+
+	return file, nil
+}
+
+func downloadReferer(media *Media) string {
+	u, err := url.Parse(media.URL)
+	if err != nil {
+		return ""
+	}
+
+	// pixiv only checks the referer is pixiv itself
+	if strings.HasSuffix(u.Hostname(), "pximg.net") {
+		return "https://www.pixiv.net/"
+	}
+
+	return media.Source
+}
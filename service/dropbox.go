@@ -25,6 +25,11 @@ func NewDropboxService() *DropboxService {
 	}
 }
 
+// KeepsOriginal makes the archive store files as the origin served them, like S3
+func (s DropboxService) KeepsOriginal() bool {
+	return viper.GetBool("dropbox.keep_original")
+}
+
 func (s DropboxService) ConsumeMedia(mediaList []*Media) {
 	db := *s.client
 
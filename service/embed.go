@@ -0,0 +1,94 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// EmbedServices are the services a group can pick with /embed, lowercased in settings
+var EmbedServices = []Type{Twitter, Pixiv, Danbooru, Tumblr, Misskey, Bluesky, Instagram, Mastodon}
+
+// Services serving media from any host a post lives on, anyone can run an instance pointing the bot to
+// internal addresses. Their embeds are only sent by url, since any group member can trigger one
+var embedURLOnlyServices = map[Type]bool{Misskey: true, Mastodon: true}
+
+// EmbedFetches tells if the bot may download the media of an embed itself, to transform it or upload it
+// when Telegram can't take the url
+func EmbedFetches(media *Media) bool {
+	return !embedURLOnlyServices[Type(media.Service)]
+}
+
+// EmbedMediaLimit is the most media an embed replies with, and the most links of a message looked at
+const EmbedMediaLimit = telegramAlbumSize
+
+// EmbedMedia replies to a group message with the media of its links and a compact caption. Nothing is
+// posted to the channel or recorded, and embeds have no like button
+func (s TelegramService) EmbedMedia(mediaList []*Media, chatID int64, replyTo int) {
+	captioned := make(map[string]bool)
+	for i, media := range mediaList {
+		if i == EmbedMediaLimit {
+			break
+		}
+
+		target := sendTarget{
+			chat:    strconv.FormatInt(chatID, 10),
+			spoiler: media.Sensitive,
+			replyTo: replyTo,
+			embed:   true,
+			urlOnly: !EmbedFetches(media),
+		}
+		// one caption per content, on its first media
+		key := media.Identity
+		if key == "" {
+			key = media.Source
+		}
+		if !captioned[key] {
+			captioned[key] = true
+			target.caption = compactCaption(media)
+		}
+
+		if _, err := s.sendMedia(media, target); err != nil {
+			log.WithFields(log.Fields{
+				"chat":  chatID,
+				"url":   media.URL,
+				"error": err,
+			}).Error("Send embed failed")
+		}
+	}
+}
+
+// compactCaption is the service and author linking to the source, in MarkdownV2
+func compactCaption(media *Media) string {
+	label := media.Service
+	if media.Author != "" {
+		label += " · " + media.Author
+	}
+	if media.Source == "" {
+		return escape(label)
+	}
+	return "[" + escape(label) + "](" + escapeLink(media.Source) + ")"
+}
+
+// IsChatAdmin tells if the user is an administrator or the creator of a group
+func (s TelegramService) IsChatAdmin(chatID int64, userID int64) bool {
+	resp, err := s.request(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID},
+	})
+	var member tgbotapi.ChatMember
+	if err == nil {
+		err = json.Unmarshal(resp.Result, &member)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"chat":  chatID,
+			"user":  userID,
+			"error": err,
+		}).Error("Get chat member failed")
+		return false
+	}
+
+	return member.IsAdministrator() || member.IsCreator()
+}
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"errors"
+	"math"
+	"path"
+	"strings"
+
+	"github.com/h2non/bimg"
+	log "github.com/sirupsen/logrus"
+)
+
+// Telegram photo limits, see https://core.telegram.org/bots/api#sendphoto
+const telegramPhotoSize = 10 * 1024 * 1024
+const telegramPhotoDimensionSum = 10000
+const telegramPhotoRatio = 20
+
+// JPEG quality range searched before falling back to scaling down
+const photoQualityMax = 92
+const photoQualityMin = 60
+const photoScaleAttempts = 5
+
+// errPhotoRatio means the image is too long or too wide to be a Telegram photo at any size
+var errPhotoRatio = errors.New("photo aspect ratio exceeds telegram limit")
+
+// fitTelegramPhoto returns a copy of the image that fits Telegram photo limits, the original is left
+// untouched for archive consumers. Images already within limits are returned as is
+func fitTelegramPhoto(original []byte) ([]byte, error) {
+	size, err := bimg.NewImage(original).Size()
+	if err != nil {
+		return nil, err
+	}
+
+	longSide := math.Max(float64(size.Width), float64(size.Height))
+	shortSide := math.Max(math.Min(float64(size.Width), float64(size.Height)), 1)
+	if longSide/shortSide > telegramPhotoRatio {
+		return nil, errPhotoRatio
+	}
+
+	width, height := size.Width, size.Height
+	if width+height > telegramPhotoDimensionSum {
+		scale := float64(telegramPhotoDimensionSum) / float64(width+height)
+		width = int(float64(width) * scale)
+		height = int(float64(height) * scale)
+	}
+
+	if width == size.Width && len(original) < telegramPhotoSize {
+		return original, nil
+	}
+
+	for attempt := 0; attempt < photoScaleAttempts; attempt++ {
+		result, err := encodeWithinSize(original, width, height)
+		if err != nil {
+			return nil, err
+		}
+		if len(result) < telegramPhotoSize {
+			log.WithFields(log.Fields{
+				"width":    width,
+				"height":   height,
+				"original": len(original),
+				"size":     len(result),
+			}).Info("Fitted photo for telegram")
+			return result, nil
+		}
+
+		// bytes scale with the area, shrink both sides by the square root with a little headroom
+		scale := math.Sqrt(float64(telegramPhotoSize)/float64(len(result))) * 0.95
+		width = int(float64(width) * scale)
+		height = int(float64(height) * scale)
+	}
+
+	return nil, errors.New("unable to fit photo into telegram size limit")
+}
+
+// padTelegramPhoto extends the short side of an image beyond the Telegram ratio limit with white, so it
+// can be sent as a photo, e.g. behind a spoiler where a document would show it
+func padTelegramPhoto(original []byte) ([]byte, error) {
+	size, err := bimg.NewImage(original).Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// a little under the limit, Telegram measures after its own scaling
+	ratio := float64(telegramPhotoRatio) * 0.95
+	width, height := size.Width, size.Height
+	if height > width {
+		width = int(math.Ceil(float64(height) / ratio))
+	} else {
+		height = int(math.Ceil(float64(width) / ratio))
+	}
+
+	padded, err := bimg.NewImage(original).Process(bimg.Options{
+		Width:      width,
+		Height:     height,
+		Embed:      true,
+		Extend:     bimg.ExtendBackground,
+		Background: bimg.Color{R: 255, G: 255, B: 255},
+		Type:       bimg.JPEG,
+		Quality:    photoQualityMax,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fitTelegramPhoto(padded)
+}
+
+// encodeWithinSize encodes to JPEG at the given dimensions, binary searching the highest quality
+// under the size limit. The lowest quality result is returned if none fits
+func encodeWithinSize(original []byte, width, height int) ([]byte, error) {
+	low, high := photoQualityMin, photoQualityMax
+	var best []byte
+	var smallest []byte
+
+	for low <= high {
+		quality := (low + high) / 2
+		result, err := bimg.NewImage(original).Process(bimg.Options{
+			Width:   width,
+			Height:  height,
+			Force:   true,
+			Quality: quality,
+			Type:    bimg.JPEG,
+			// transparent areas turn black in JPEG otherwise
+			Background: bimg.Color{R: 255, G: 255, B: 255},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result) < telegramPhotoSize {
+			best = result
+			low = quality + 1
+		} else {
+			smallest = result
+			high = quality - 1
+		}
+	}
+
+	if best != nil {
+		return best, nil
+	}
+
+	return smallest, nil
+}
+
+// sliceTallImage cuts an image taller than ratio times its width into vertical slices, each overlapping
+// the previous one so no line of text is lost on the cut. Returns nil when the image needs no slicing
+func sliceTallImage(original []byte, ratio float64, overlap int) ([][]byte, error) {
+	if ratio <= 0 {
+		return nil, nil
+	}
+
+	size, err := bimg.NewImage(original).Size()
+	if err != nil {
+		return nil, err
+	}
+	if size.Width == 0 || float64(size.Height)/float64(size.Width) <= ratio {
+		return nil, nil
+	}
+
+	maxHeight := int(float64(size.Width) * ratio)
+	if overlap < 0 {
+		overlap = 0
+	}
+	if overlap > maxHeight/2 {
+		overlap = maxHeight / 2
+	}
+
+	// spread the cuts evenly, so the last slice isn't a sliver
+	count := int(math.Ceil(float64(size.Height-overlap) / float64(maxHeight-overlap)))
+	height := int(math.Ceil(float64(size.Height+(count-1)*overlap) / float64(count)))
+
+	var slices [][]byte
+	for i := 0; i < count; i++ {
+		top := i * (height - overlap)
+		if top+height > size.Height {
+			top = size.Height - height
+		}
+
+		slice, err := bimg.NewImage(original).Extract(top, 0, size.Width, height)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, slice)
+	}
+
+	log.WithFields(log.Fields{
+		"width":  size.Width,
+		"height": size.Height,
+		"slices": count,
+	}).Info("Sliced tall image")
+
+	return slices, nil
+}
+
+// Photo formats Telegram takes as they are, everything else is converted
+var telegramPhotoTypes = map[bimg.ImageType]bool{bimg.JPEG: true, bimg.PNG: true}
+
+// Photo urls Telegram would show as stickers or documents, downloaded to be converted
+var convertExtensions = map[string]bool{".webp": true, ".avif": true, ".heic": true, ".heif": true, ".tif": true, ".tiff": true, ".bmp": true, ".jxl": true}
+
+// ImageNormalizer converts photos to JPEG or PNG and strips EXIF, GPS included, from the copies we upload
+type ImageNormalizer struct{}
+
+func NewImageNormalizer() *ImageNormalizer {
+	return &ImageNormalizer{}
+}
+
+func (n ImageNormalizer) Transform(media *Media) (*Media, error) {
+	if media.Type != "photo" || len(media.TGFileID) != 0 {
+		return media, nil
+	}
+
+	result := *media
+	if media.File == nil {
+		// Telegram re-encodes photos it fetches, metadata doesn't survive
+		if !convertExtensions[mediaExtension(media)] {
+			return media, nil
+		}
+
+		file, err := downloadMedia(media)
+		if err != nil {
+			return media, err
+		}
+		result.File = &file
+	}
+
+	normalized, ext, err := normalizeImage(*result.File)
+	if err != nil {
+		return media, err
+	}
+	if normalized != nil {
+		result.File = &normalized
+		result.FileName = strings.TrimSuffix(media.FileName, path.Ext(media.FileName)) + ext
+	}
+
+	return &result, nil
+}
+
+// normalizeImage converts to JPEG, or PNG to keep transparency, and drops metadata. Returns nil when
+// the image is already a supported format without metadata
+func normalizeImage(original []byte) ([]byte, string, error) {
+	image := bimg.NewImage(original)
+	metadata, err := image.Metadata()
+	if err != nil {
+		return nil, "", err
+	}
+
+	imageType := bimg.DetermineImageType(original)
+	// opaque PNGs over the photo limit are better off as JPEG than scaled down
+	hugePNG := imageType == bimg.PNG && !metadata.Alpha && len(original) >= telegramPhotoSize
+	if telegramPhotoTypes[imageType] && metadata.EXIF == (bimg.EXIF{}) && !hugePNG {
+		return nil, "", nil
+	}
+
+	targetType, ext := bimg.JPEG, ".jpg"
+	if (imageType == bimg.PNG && !hugePNG) || (!telegramPhotoTypes[imageType] && metadata.Alpha) {
+		targetType, ext = bimg.PNG, ".png"
+	}
+
+	// rotation comes from the orientation tag, bake it in before the tag goes
+	normalized, err := image.Process(bimg.Options{
+		Type:          targetType,
+		Quality:       photoQualityMax,
+		StripMetadata: true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	log.WithFields(log.Fields{
+		"from": bimg.ImageTypeName(imageType),
+		"to":   bimg.ImageTypeName(targetType),
+	}).Debug("Normalized image")
+
+	return normalized, ext, nil
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"html"
 	"io"
@@ -57,10 +58,17 @@ func (s InstagramService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
+func (s InstagramService) Identity(incomingURL *IncomingURL) string {
+	return "instagram:" + incomingURL.StrID
+}
+
+// StoredIdentity is never derived, shortcodes are case sensitive and url keys were lowercased
+func (s InstagramService) StoredIdentity(incomingURL *IncomingURL) (string, bool) {
+	return "", false
+}
 
-func (s InstagramService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error) {
-	var result []*Media
 
+func (s InstagramService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error) {
 	log.WithFields(log.Fields{
 		"url": incomingURL.URL,
 	}).Debug("Extracting Instagram media")
@@ -75,6 +83,60 @@ func (s InstagramService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Medi
 		}
 	}
 
+	// Carousel posts only expose every item in the embed page's structured data
+	items, owner, err := s.extractEmbedItems(incomingURL)
+	if err != nil || len(items) == 0 {
+		log.WithFields(log.Fields{
+			"url":   incomingURL.URL,
+			"error": err,
+		}).Debug("No embed data, fall back to direct media URL")
+		return s.extractDirectMedia(incomingURL, metadata)
+	}
+
+	if metadata.Author == "" && owner != "" {
+		metadata.Author = owner
+		metadata.AuthorURL = fmt.Sprintf("https://www.instagram.com/%s", owner)
+	}
+
+	var result []*Media
+	for _, item := range items {
+		var media *Media
+		if item.IsVideo {
+			media = &Media{
+				FileName: s.fileName(incomingURL.StrID, item.position, "mp4"),
+				URL:      item.VideoURL,
+				Type:     "video",
+			}
+		} else {
+			media = &Media{
+				FileName: s.fileName(incomingURL.StrID, item.position, "jpg"),
+				URL:      item.DisplayURL,
+				Type:     "photo",
+			}
+		}
+
+		media.Source = incomingURL.URL
+		media.Service = string(s.Service)
+		media.Author = metadata.Author
+		media.AuthorURL = metadata.AuthorURL
+		media.Title = metadata.Title
+		media.Description = metadata.Description
+		result = append(result, media)
+	}
+
+	log.WithFields(log.Fields{
+		"url":    incomingURL.URL,
+		"author": metadata.Author,
+		"count":  len(result),
+	}).Info("Successfully extracted Instagram media")
+
+	return result, nil
+}
+
+// extractDirectMedia uses the /media/ redirect, which only points to the first item of a post
+func (s InstagramService) extractDirectMedia(incomingURL *IncomingURL, metadata *instagramMetadata) ([]*Media, error) {
+	var result []*Media
+
 	// Get the direct media URL
 	pathType := s.getPathType(incomingURL.URL)
 	mediaURL := fmt.Sprintf("https://www.instagram.com/%s/%s/media/?size=l", pathType, incomingURL.StrID)
@@ -99,10 +161,10 @@ func (s InstagramService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Medi
 		var fileName string
 		var mediaType string
 		if strings.Contains(contentType, "image") {
-			fileName = fmt.Sprintf("instagram_%s.jpg", incomingURL.StrID)
+			fileName = s.fileName(incomingURL.StrID, 0, "jpg")
 			mediaType = "photo"
 		} else if strings.Contains(contentType, "video") {
-			fileName = fmt.Sprintf("instagram_%s.mp4", incomingURL.StrID)
+			fileName = s.fileName(incomingURL.StrID, 0, "mp4")
 			mediaType = "video"
 		} else {
 			return result, fmt.Errorf("unsupported content type: %s", contentType)
@@ -138,6 +200,11 @@ func (s InstagramService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Medi
 	return result, fmt.Errorf("direct media URL returned status %d", resp.StatusCode)
 }
 
+// fileName gives every item of a post a stable name, e.g. instagram_C1a2b3_2.jpg
+func (s InstagramService) fileName(postID string, index int, ext string) string {
+	return fmt.Sprintf("instagram_%s_%d.%s", postID, index+1, ext)
+}
+
 // getPathType determines if the URL is for a post or reel
 func (s InstagramService) getPathType(urlString string) string {
 	if strings.Contains(urlString, "/reel/") {
@@ -295,3 +362,109 @@ func extractOGValue(pattern *regexp.Regexp, body []byte) string {
 	return ""
 }
 
+// instagramShortcodeMedia is the shortcode_media object found in the embed page
+type instagramShortcodeMedia struct {
+	TypeName   string `json:"__typename"`
+	DisplayURL string `json:"display_url"`
+	IsVideo    bool   `json:"is_video"`
+	VideoURL   string `json:"video_url"`
+	Owner      struct {
+		Username string
+	}
+	EdgeSidecarToChildren struct {
+		Edges []struct {
+			Node instagramShortcodeMedia
+		}
+	} `json:"edge_sidecar_to_children"`
+
+	// position of the item in the post, kept when unusable items are dropped
+	position int
+}
+
+// extractEmbedItems reads every item of a post, carousel children included, from the embed page
+func (s InstagramService) extractEmbedItems(incomingURL *IncomingURL) (items []instagramShortcodeMedia, owner string, err error) {
+	pathType := s.getPathType(incomingURL.URL)
+	embedURL := fmt.Sprintf("https://www.instagram.com/%s/%s/embed/captioned/", pathType, incomingURL.StrID)
+
+	req, err := http.NewRequest("GET", embedURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	shortcodeMedia, err := parseInstagramEmbed(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if edges := shortcodeMedia.EdgeSidecarToChildren.Edges; len(edges) > 0 {
+		for position, edge := range edges {
+			edge.Node.position = position
+			items = append(items, edge.Node)
+		}
+	} else {
+		items = append(items, *shortcodeMedia)
+	}
+
+	// drop items we can't download, e.g. videos the embed page only shows a cover for
+	var usable []instagramShortcodeMedia
+	for _, item := range items {
+		if item.IsVideo && item.VideoURL == "" {
+			log.WithField("url", incomingURL.URL).Debug("Skip Instagram video without video_url")
+			continue
+		}
+		if !item.IsVideo && item.DisplayURL == "" {
+			continue
+		}
+		usable = append(usable, item)
+	}
+
+	return usable, shortcodeMedia.Owner.Username, nil
+}
+
+var (
+	embedContextJSONRegex = regexp.MustCompile(`"contextJSON":("(?:[^"\\]|\\.)*")`)
+	embedAdditionalRegex  = regexp.MustCompile(`(?s)window\.__additionalDataLoaded\(\s*'[^']*'\s*,\s*(\{.+?\})\s*\);`)
+)
+
+// parseInstagramEmbed finds shortcode_media in either of the two layouts the embed page uses
+func parseInstagramEmbed(body []byte) (*instagramShortcodeMedia, error) {
+	data := struct {
+		ShortcodeMedia *instagramShortcodeMedia `json:"shortcode_media"`
+		GqlData        *struct {
+			ShortcodeMedia *instagramShortcodeMedia `json:"shortcode_media"`
+		} `json:"gql_data"`
+	}{}
+
+	if match := embedContextJSONRegex.FindSubmatch(body); match != nil {
+		// contextJSON is a JSON document encoded as a JSON string
+		var contextJSON string
+		if err := json.Unmarshal(match[1], &contextJSON); err == nil {
+			if err := json.Unmarshal([]byte(contextJSON), &data); err == nil && data.GqlData != nil && data.GqlData.ShortcodeMedia != nil {
+				return data.GqlData.ShortcodeMedia, nil
+			}
+		}
+	}
+
+	if match := embedAdditionalRegex.FindSubmatch(body); match != nil {
+		if err := json.Unmarshal(match[1], &data); err == nil && data.ShortcodeMedia != nil {
+			return data.ShortcodeMedia, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no shortcode_media found in embed page")
+}
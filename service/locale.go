@@ -0,0 +1,203 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/wxt2005/image-capture-bot-go/db"
+)
+
+const (
+	LanguageChinese = "zh"
+	LanguageEnglish = "en"
+)
+
+// Languages in the order /lang lists them
+var Languages = []string{LanguageChinese, LanguageEnglish}
+
+// messageCatalog holds every text the bot sends, formatted with fmt verbs
+var messageCatalog = map[string]map[string]string{
+	LanguageChinese: {
+		"language.name":              "中文",
+		"welcome":                    "meow",
+		"auth.success":               "授权成功",
+		"auth.failed":                "授权失败",
+		"revoke.success":             "解除授权成功",
+		"revoke.failed":              "解除授权失败",
+		"no_permission":              "您没有执行此操作的权限，请联系管理员",
+		"button.like":                "❤️ Like",
+		"button.force":               "强制发送",
+		"button.retry":               "🔄 重试",
+		"duplicate.url":              "图片地址重复: %s",
+		"duplicate.first_seen":       "首次发送: %s",
+		"duplicate.post":             "频道消息: %s ❤️ %d",
+		"status.pending":             "⏳ %s 处理中",
+		"status.posted":              "✅ %s 已发送",
+		"status.unsupported":         "⚠️ %s 不支持",
+		"status.duplicate":           "🔁 %s 重复",
+		"status.failed":              "❌ %s 失败: %s",
+		"slices.notice":              "长图已切分为 %d 张",
+		"caption.author":             "作者",
+		"caption.source":             "来源",
+		"caption.more":               "全文",
+		"lang.current":               "当前语言: %s\n可选: %s\n用法: /lang <代码>",
+		"lang.changed":               "语言已切换为中文",
+		"lang.unsupported":           "不支持的语言: %s\n可选: %s",
+		"status.queued":              "🕒 %s 已排队",
+		"queue.empty":                "%s 的队列为空",
+		"queue.header":               "%s 待发送 %d 条, 下一条 %s",
+		"queue.others":               "其他频道: %s",
+		"queue.cleared":              "已清空 %d 条",
+		"queue.moved":                "已将 #%d 移到 #%d",
+		"queue.posted":               "已发送 #%d",
+		"queue.not_found":            "队列中没有 #%d",
+		"queue.usage":                "用法: /queue [频道], /queue [频道] clear, /queue [频道] move <从> <到>, /now [频道] [序号]",
+		"status.review":              "🕵️ %s 待审核",
+		"button.approve":             "✅ 通过",
+		"button.reject":              "🚫 拒绝",
+		"button.caption":             "✏️ 修改说明",
+		"moderation.preview":         "待审核 %d 项, 来自 %s",
+		"moderation.approved":        "✅ 已由 %s 通过",
+		"moderation.rejected":        "🚫 已由 %s 拒绝",
+		"moderation.caption_prompt":  "请回复此消息, 发送新的说明",
+		"moderation.caption_updated": "说明已更新",
+		"moderation.decided":         "该投稿已处理",
+		"moderation.notify_approved": "您的投稿已通过:\n%s",
+		"moderation.notify_rejected": "您的投稿未通过:\n%s",
+		"post.not_found":             "找不到该频道消息, 请回复转发的频道消息或提供编号, 如 twitter:123",
+		"post.usage":                 "用法: /delete, /recaption <说明>, /repost <频道>, 回复转发的频道消息或在命令后加编号",
+		"post.deleted":               "已删除 %d 条",
+		"post.recaptioned":           "已修改 %d 条",
+		"post.reposted":              "已转发 %d 条到 %s",
+		"embed.status":               "链接预览: %s\n服务: %s",
+		"embed.on":                   "开启",
+		"embed.off":                  "关闭",
+		"embed.all_services":         "全部",
+		"embed.usage":                "用法: /embed, /embed on, /embed off, /embed services <服务...|all>\n可选服务: %s",
+		"embed.unknown_service":      "不支持的服务: %s\n可选服务: %s",
+	},
+	LanguageEnglish: {
+		"language.name":              "English",
+		"welcome":                    "meow",
+		"auth.success":               "Authorized",
+		"auth.failed":                "Authorization failed",
+		"revoke.success":             "Authorization revoked",
+		"revoke.failed":              "Revoking authorization failed",
+		"no_permission":              "You are not allowed to do this, please contact the admin",
+		"button.like":                "❤️ Like",
+		"button.force":               "Send anyway",
+		"button.retry":               "🔄 Retry",
+		"duplicate.url":              "Duplicate url: %s",
+		"duplicate.first_seen":       "First sent: %s",
+		"duplicate.post":             "Channel post: %s ❤️ %d",
+		"status.pending":             "⏳ %s processing",
+		"status.posted":              "✅ %s posted",
+		"status.unsupported":         "⚠️ %s unsupported",
+		"status.duplicate":           "🔁 %s duplicate",
+		"status.failed":              "❌ %s failed: %s",
+		"slices.notice":              "Long image cut into %d parts",
+		"caption.author":             "Author",
+		"caption.source":             "Source",
+		"caption.more":               "more",
+		"lang.current":               "Language: %s\nAvailable: %s\nUsage: /lang <code>",
+		"lang.changed":               "Language set to English",
+		"lang.unsupported":           "Unsupported language: %s\nAvailable: %s",
+		"status.queued":              "🕒 %s queued",
+		"queue.empty":                "The queue of %s is empty",
+		"queue.header":               "%s: %d pending, next at %s",
+		"queue.others":               "Other channels: %s",
+		"queue.cleared":              "Cleared %d items",
+		"queue.moved":                "Moved #%d to #%d",
+		"queue.posted":               "Posted #%d",
+		"queue.not_found":            "No #%d in the queue",
+		"queue.usage":                "Usage: /queue [channel], /queue [channel] clear, /queue [channel] move <from> <to>, /now [channel] [position]",
+		"status.review":              "🕵️ %s awaiting review",
+		"button.approve":             "✅ Approve",
+		"button.reject":              "🚫 Reject",
+		"button.caption":             "✏️ Edit caption",
+		"moderation.preview":         "%d items to review, from %s",
+		"moderation.approved":        "✅ Approved by %s",
+		"moderation.rejected":        "🚫 Rejected by %s",
+		"moderation.caption_prompt":  "Reply to this message with the new caption",
+		"moderation.caption_updated": "Caption updated",
+		"moderation.decided":         "This submission was already decided",
+		"moderation.notify_approved": "Your submission was approved:\n%s",
+		"moderation.notify_rejected": "Your submission was rejected:\n%s",
+		"post.not_found":             "Post not found, reply to a forwarded channel post or give a catalog id such as twitter:123",
+		"post.usage":                 "Usage: /delete, /recaption <caption>, /repost <channel>, as a reply to a forwarded channel post or with a catalog id first",
+		"post.deleted":               "Deleted %d posts",
+		"post.recaptioned":           "Edited %d posts",
+		"post.reposted":              "Reposted %d posts to %s",
+		"embed.status":               "Link previews: %s\nServices: %s",
+		"embed.on":                   "on",
+		"embed.off":                  "off",
+		"embed.all_services":         "all",
+		"embed.usage":                "Usage: /embed, /embed on, /embed off, /embed services <service...|all>\nServices: %s",
+		"embed.unknown_service":      "Unknown service: %s\nServices: %s",
+	},
+}
+
+// Translate returns the message of key in lang formatted with args, falling back to the default language
+func Translate(lang string, key string, args ...interface{}) string {
+	message, ok := messageCatalog[lang][key]
+	if !ok {
+		message, ok = messageCatalog[defaultLanguage()][key]
+	}
+	if !ok {
+		log.WithFields(log.Fields{
+			"lang": lang,
+			"key":  key,
+		}).Warn("Missing message in catalog")
+		return key
+	}
+
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+func defaultLanguage() string {
+	if lang, ok := SupportedLanguage(viper.GetString("telegram.language")); ok {
+		return lang
+	}
+	return LanguageChinese
+}
+
+// SupportedLanguage maps a language code such as "en-US" or "zh-hans" to a catalog language
+func SupportedLanguage(code string) (string, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for _, lang := range Languages {
+		if code == lang || strings.HasPrefix(code, lang+"-") || strings.HasPrefix(code, lang+"_") {
+			return lang, true
+		}
+	}
+	return "", false
+}
+
+// UserLanguage is the language picked with /lang, else the one of the user's Telegram client, else
+// telegram.language
+func UserLanguage(user *tgbotapi.User) string {
+	if user == nil {
+		return defaultLanguage()
+	}
+
+	saved, err := db.GetUserLanguage(user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  user.ID,
+			"error": err,
+		}).Error("Get user language failed")
+	}
+	if lang, ok := SupportedLanguage(saved); ok {
+		return lang
+	}
+	if lang, ok := SupportedLanguage(user.LanguageCode); ok {
+		return lang
+	}
+
+	return defaultLanguage()
+}
@@ -1,22 +1,29 @@
 package service
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wxt2005/image-capture-bot-go/db"
 )
 
 type Type string
 
 const (
-	Twitter   Type = "Twitter"
-	Tumblr    Type = "Tumblr"
-	Pixiv     Type = "Pixiv"
-	Danbooru  Type = "Danbooru"
+	Twitter  Type = "Twitter"
+	Tumblr   Type = "Tumblr"
+	Pixiv    Type = "Pixiv"
+	Danbooru Type = "Danbooru"
 	// Dropbox  Type = "Dropbox"
 	Telegram  Type = "Telegram"
 	Misskey   Type = "Misskey"
 	Bluesky   Type = "Bluesky"
 	S3        Type = "S3"
 	Instagram Type = "Instagram"
+	Mastodon  Type = "Mastodon"
 )
 
 type Media struct {
@@ -31,6 +38,27 @@ type Media struct {
 	AuthorURL   string
 	Title       string
 	Description string
+	// RichDescription is Description with its links, set by providers whose text has markup
+	RichDescription RichText `json:"-"`
+	AltText         string
+	Tags            []string
+	// Sensitive marks media flagged as NSFW or hidden behind a content warning
+	Sensitive      bool
+	ContentWarning string
+	// Width and Height as reported by the provider, 0 if unknown
+	Width  int
+	Height int
+	// Duration of videos and animations in seconds, 0 if unknown
+	Duration  int
+	Thumbnail *[]byte `json:"-"`
+	// SendOriginal asks Telegram to send the untouched file as a document too, set per message
+	SendOriginal bool `json:"-"`
+	// Original is the media as extracted, set on copies made by the transform stage
+	Original *Media `json:"-"`
+	// Identity of the content the media was extracted from, see IncomingURL.Identity
+	Identity string
+	// Channel Telegram posts the media in, telegram.channel_name when empty
+	Channel string `json:"-"`
 }
 
 type IncomingURL struct {
@@ -40,18 +68,93 @@ type IncomingURL struct {
 	Host     string
 	StrID    string
 	IntID    int
+	// Identity is the canonical "service:id" key of the content, used for deduplication
+	Identity string
 }
 
 type ProviderService interface {
 	IsService(Type Type) bool
 	CheckValid(urlString string) (*IncomingURL, bool)
+	// Identity returns the canonical "service:id" of the content behind the URL,
+	// stable across every URL form pointing to the same content
+	Identity(incomingURL *IncomingURL) string
 	ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error)
 }
 
+// offlineMatcher is a provider that may ask the network whether it supports a url. CheckValidOffline
+// matches without asking, false when it can't tell
+type offlineMatcher interface {
+	CheckValidOffline(urlString string) (*IncomingURL, bool)
+}
+
+// storedIdentifier is a provider whose identity can't always be derived from a lowercased url key,
+// because it needs the network or its ids are case sensitive
+type storedIdentifier interface {
+	StoredIdentity(incomingURL *IncomingURL) (string, bool)
+}
+
 type ConsumerService interface {
 	ConsumeMedia(mediaList []*Media)
 }
 
+// ReportingConsumer is a consumer telling how posting went, ServiceManager waits for it
+type ReportingConsumer interface {
+	PostMedia(mediaList []*Media) ConsumeResult
+}
+
+// ConsumeResult is how posting went for each content, by identity. A nil error means every media of the
+// content was posted
+type ConsumeResult map[string]error
+
+var errNotPosted = errors.New("not posted")
+
+// Err is why the content of identity was not posted, nil if it was
+func (r ConsumeResult) Err(identity string) error {
+	err, ok := r[identity]
+	if !ok {
+		return errNotPosted
+	}
+	return err
+}
+
+// Failed tells if any content was not posted
+func (r ConsumeResult) Failed() bool {
+	for _, err := range r {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryErr is the first failure worth trying again, rejections by a channel policy are final
+func (r ConsumeResult) RetryErr() error {
+	for _, err := range r {
+		if err != nil && !errors.Is(err, ErrMediaRejected) {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail records err for identity, keeping the first error
+func (r ConsumeResult) fail(identity string, err error) {
+	if r[identity] == nil {
+		r[identity] = err
+	}
+}
+
+// ArchiveConsumer is a consumer keeping media as the origin served it, it skips the transform stage
+type ArchiveConsumer interface {
+	KeepsOriginal() bool
+}
+
+// MediaTransformer rewrites media between extraction and consumption, e.g. transcoding. It returns a
+// modified copy, the media given is shared and must not be changed
+type MediaTransformer interface {
+	Transform(media *Media) (*Media, error)
+}
+
 type AllServices struct {
 	Danbooru  *DanbooruService
 	Pixiv     *PixivService
@@ -60,15 +163,19 @@ type AllServices struct {
 	Misskey   *MisskeyService
 	Bluesky   *BlueskyService
 	Instagram *InstagramService
+	Mastodon  *MastodonService
 	// Dropbox  *DropboxService
-	Telegram  *TelegramService
-	S3        *S3Service
+	Telegram *TelegramService
+	S3       *S3Service
 }
 
 type ServiceManager struct {
-	Providers []ProviderService
-	Consumers []ConsumerService
-	All       *AllServices
+	Providers    []ProviderService
+	Consumers    []ConsumerService
+	Transformers []MediaTransformer
+	All          *AllServices
+	Normalizer   *URLNormalizer
+	Queue        *PostQueue
 }
 
 var serviceManagerInstance *ServiceManager
@@ -83,18 +190,25 @@ func GetServiceManager() *ServiceManager {
 		misskey := NewMisskeyService()
 		bluesky := NewBlueskyService()
 		instagram := NewInstagramService()
+		mastodon := NewMastodonService()
 		// dropbox := NewDropboxService()
 		telegram := NewTelegramService()
 		s3 := NewS3Service()
 
-		allServices := &AllServices{danbooru, pixiv, tumblr, twitter, misskey, bluesky, instagram, telegram, s3}
-		providers := []ProviderService{danbooru, pixiv, tumblr, twitter, misskey, bluesky, instagram}
+		allServices := &AllServices{danbooru, pixiv, tumblr, twitter, misskey, bluesky, instagram, mastodon, telegram, s3}
+		// mastodon goes last, it asks nodeinfo about every host matching its loose pattern
+		providers := []ProviderService{danbooru, pixiv, tumblr, twitter, misskey, bluesky, instagram, mastodon}
 		consumers := []ConsumerService{telegram, s3}
 
+		transformers := []MediaTransformer{NewImageNormalizer(), NewVideoTranscoder(), NewMediaProber()}
+
 		serviceManagerInstance = &ServiceManager{
-			Providers: providers,
-			Consumers: consumers,
-			All:       allServices,
+			Providers:    providers,
+			Consumers:    consumers,
+			Transformers: transformers,
+			All:          allServices,
+			Normalizer:   NewURLNormalizer(),
+			Queue:        NewPostQueue(),
 		}
 	})
 	return serviceManagerInstance
@@ -102,35 +216,195 @@ func GetServiceManager() *ServiceManager {
 
 func (s ServiceManager) BuildIncomingURL(urlList *[]string) (result []*IncomingURL) {
 	for _, urlString := range *urlList {
-		for _, provider := range s.Providers {
-			if incomingURL, ok := provider.CheckValid(urlString); ok {
-				result = append(result, incomingURL)
-				break
-			}
+		if incomingURL, ok := s.MatchURL(urlString); ok {
+			result = append(result, incomingURL)
 		}
 	}
 
 	return
 }
 
+// MatchURL finds the provider of a single url, false if no provider supports it
+func (s ServiceManager) MatchURL(urlString string) (*IncomingURL, bool) {
+	normalizedURL := s.Normalizer.Normalize(urlString)
+	for _, provider := range s.Providers {
+		if incomingURL, ok := provider.CheckValid(normalizedURL); ok {
+			incomingURL.Original = urlString
+			incomingURL.Identity = provider.Identity(incomingURL)
+			return incomingURL, true
+		}
+	}
+
+	return nil, false
+}
+
+// StoredIdentity derives the identity of a lowercased url key stored before identities, without any
+// network call. False if no provider matches it offline or its identity can't be derived from it
+func (s ServiceManager) StoredIdentity(key string) (string, bool) {
+	normalizedURL := s.Normalizer.NormalizeOffline(key)
+	for _, provider := range s.Providers {
+		var incomingURL *IncomingURL
+		var ok bool
+		if matcher, isMatcher := provider.(offlineMatcher); isMatcher {
+			incomingURL, ok = matcher.CheckValidOffline(normalizedURL)
+		} else {
+			incomingURL, ok = provider.CheckValid(normalizedURL)
+		}
+		if !ok {
+			continue
+		}
+
+		if identifier, isIdentifier := provider.(storedIdentifier); isIdentifier {
+			return identifier.StoredIdentity(incomingURL)
+		}
+		return provider.Identity(incomingURL), true
+	}
+
+	return "", false
+}
+
+// CleanIdentity lowercases the service and host of an identity typed by hand, ids keep their case
+func CleanIdentity(identity string) string {
+	identity = strings.TrimSpace(identity)
+	end := strings.LastIndex(identity, "/")
+	if end == -1 {
+		end = strings.Index(identity, ":")
+	}
+	if end == -1 {
+		return identity
+	}
+	return strings.ToLower(identity[:end]) + identity[end:]
+}
+
+// identityHost strips the scheme from a host prefix such as https://misskey.io
+func identityHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	return strings.ToLower(host)
+}
+
 func (s ServiceManager) ExtraMediaFromURL(incomingURLList []*IncomingURL) (result []*Media) {
 	for _, incomingURL := range incomingURLList {
-		for _, provider := range s.Providers {
-			if !provider.IsService(incomingURL.Service) {
-				continue
-			}
-
-			if media, err := provider.ExtractMediaFromURL(incomingURL); err == nil {
-				result = append(result, media...)
-			}
+		if media, err := s.ExtractMediaFromIncomingURL(incomingURL); err == nil {
+			result = append(result, media...)
 		}
 	}
 
 	return
 }
 
+// ExtractMediaFromIncomingURL extracts the media of a single url, returning the provider error if any
+func (s ServiceManager) ExtractMediaFromIncomingURL(incomingURL *IncomingURL) ([]*Media, error) {
+	for _, provider := range s.Providers {
+		if !provider.IsService(incomingURL.Service) {
+			continue
+		}
+
+		media, err := provider.ExtractMediaFromURL(incomingURL)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range media {
+			item.Identity = incomingURL.Identity
+		}
+		return media, nil
+	}
+
+	return nil, fmt.Errorf("no provider for service %s", incomingURL.Service)
+}
+
+// Publish posts media now, or queues it when the drip-feed queue is on. Returns the queue position, 0 if
+// posted right away. Posting runs in the background, done gets how it went if not nil
+func (s ServiceManager) Publish(media []*Media, submitter string, done func(ConsumeResult)) (int, error) {
+	if !s.Queue.Enabled() {
+		go func() {
+			result := s.PostMedia(media)
+			if done != nil {
+				done(result)
+			}
+		}()
+		return 0, nil
+	}
+
+	return s.Queue.Push(media, submitter)
+}
+
+// RunPostQueue posts queued media as it comes due, it blocks
+func (s ServiceManager) RunPostQueue() {
+	if !s.Queue.Enabled() {
+		return
+	}
+	s.Queue.Run(s.PostMedia)
+}
+
 func (s ServiceManager) ConsumeMedia(media []*Media) {
+	go s.PostMedia(media)
+}
+
+// PostMedia sends media to every consumer and waits for the ones reporting how it went
+func (s ServiceManager) PostMedia(media []*Media) ConsumeResult {
+	result := make(ConsumeResult)
+	var transformConsumers []ConsumerService
 	for _, consumer := range s.Consumers {
-		go consumer.ConsumeMedia(media)
+		if archive, ok := consumer.(ArchiveConsumer); ok && archive.KeepsOriginal() {
+			go consumer.ConsumeMedia(media)
+			continue
+		}
+		transformConsumers = append(transformConsumers, consumer)
+	}
+
+	if len(transformConsumers) == 0 {
+		return result
+	}
+
+	transformed := s.TransformMedia(media)
+	for _, consumer := range transformConsumers {
+		reporting, ok := consumer.(ReportingConsumer)
+		if !ok {
+			go consumer.ConsumeMedia(transformed)
+			continue
+		}
+		for identity, err := range reporting.PostMedia(transformed) {
+			result.fail(identity, err)
+		}
+	}
+
+	// turned away for good, the content may be submitted again
+	for identity, err := range result {
+		if errors.Is(err, ErrMediaRejected) && identity != "" {
+			if err := db.ReleaseURLRecord(identity); err != nil {
+				log.WithFields(log.Fields{
+					"identity": identity,
+					"error":    err,
+				}).Error("Release rejected url record failed")
+			}
+		}
 	}
+
+	return result
+}
+
+// TransformMedia runs media through every transformer, a failed transform leaves the media as it was
+func (s ServiceManager) TransformMedia(mediaList []*Media) []*Media {
+	result := make([]*Media, 0, len(mediaList))
+	for _, original := range mediaList {
+		media := original
+		for _, transformer := range s.Transformers {
+			transformed, err := transformer.Transform(media)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"url":   media.URL,
+					"error": err,
+				}).Error("Transform media failed")
+				continue
+			}
+			media = transformed
+		}
+		if media != original {
+			media.Original = original
+		}
+		result = append(result, media)
+	}
+
+	return result
 }
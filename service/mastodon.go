@@ -0,0 +1,203 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Software names reported by nodeinfo for servers speaking the Mastodon API
+var mastodonSoftware = []string{"mastodon", "pleroma", "akkoma", "gotosocial", "hometown", "glitchsoc"}
+
+type MastodonService struct {
+	Service   Type
+	urlRegexp *regexp.Regexp
+	client    *http.Client
+}
+
+type MastodonAttachment struct {
+	ID          string
+	Type        string // image, gifv, video, audio, unknown
+	URL         string
+	RemoteURL   string `json:"remote_url"`
+	Description string
+}
+
+type MastodonAccount struct {
+	Username    string
+	Acct        string
+	DisplayName string `json:"display_name"`
+	URL         string
+}
+
+type MastodonStatus struct {
+	ID               string
+	URL              string
+	Content          string
+	Sensitive        bool
+	SpoilerText      string `json:"spoiler_text"`
+	Account          MastodonAccount
+	MediaAttachments []MastodonAttachment `json:"media_attachments"`
+	Reblog           *MastodonStatus
+}
+
+func NewMastodonService() *MastodonService {
+	return &MastodonService{
+		Service: Mastodon,
+		// https://host/@user/id, https://host/notice/id, https://host/users/user/statuses/id
+		urlRegexp: regexp.MustCompile(`(?i)(https?:\/\/([\w.-]+))\/(?:@[\w.@-]+|notice|users\/[\w.-]+\/statuses)\/(\w+)`),
+		// servers are whatever host was submitted
+		client: newPublicClient(0),
+	}
+}
+
+func (s MastodonService) CheckValid(urlString string) (*IncomingURL, bool) {
+	match := s.urlRegexp.FindStringSubmatch(urlString)
+	if match == nil {
+		return nil, false
+	}
+
+	if !GetNodeInfoResolver().IsSoftware(match[2], mastodonSoftware) {
+		return nil, false
+	}
+
+	return &IncomingURL{
+		Service:  s.Service,
+		Original: urlString,
+		URL:      match[0],
+		Host:     match[1],
+		StrID:    match[3],
+		IntID:    0,
+	}, true
+}
+
+// CheckValidOffline never matches, servers are only known through nodeinfo
+func (s MastodonService) CheckValidOffline(urlString string) (*IncomingURL, bool) {
+	return nil, false
+}
+
+func (s MastodonService) IsService(serviceType Type) bool {
+	return serviceType == s.Service
+}
+
+// Identity includes the host, status ids are only unique per server
+func (s MastodonService) Identity(incomingURL *IncomingURL) string {
+	return fmt.Sprintf("mastodon:%s/%s", identityHost(incomingURL.Host), incomingURL.StrID)
+}
+
+func (s MastodonService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error) {
+	var result []*Media
+
+	if incomingURL.StrID == "" {
+		return result, nil
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/statuses/%s", incomingURL.Host, incomingURL.StrID), nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Get Mastodon status failed")
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Get Mastodon status failed")
+		return result, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.WithFields(log.Fields{
+			"status_code": resp.StatusCode,
+			"body":        string(body),
+		}).Error("Get Mastodon status failed")
+		return result, fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
+	}
+
+	status := MastodonStatus{}
+	if err := json.Unmarshal(body, &status); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Get Mastodon status failed")
+		return result, err
+	}
+
+	source := incomingURL.URL
+	// boost, use the original status instead
+	if status.Reblog != nil {
+		status = *status.Reblog
+		if status.URL != "" {
+			source = status.URL
+		}
+	}
+
+	for index, attachment := range status.MediaAttachments {
+		var mediaType string
+		switch attachment.Type {
+		case "image":
+			mediaType = "photo"
+		case "gifv":
+			mediaType = "animation"
+		case "video":
+			mediaType = "video"
+		default:
+			continue
+		}
+
+		mediaURL := attachment.URL
+		if mediaURL == "" {
+			mediaURL = attachment.RemoteURL
+		}
+		if mediaURL == "" {
+			continue
+		}
+
+		media := &Media{
+			FileName: s.fileName(&status, index, mediaURL),
+			URL:      mediaURL,
+			Type:     mediaType,
+			Source:   source,
+			Service:  string(s.Service),
+		}
+		s.completeMediaMeta(media, &status, &attachment)
+		result = append(result, media)
+	}
+
+	return result, nil
+}
+
+func (s MastodonService) completeMediaMeta(media *Media, status *MastodonStatus, attachment *MastodonAttachment) {
+	media.Author = status.Account.DisplayName
+	if media.Author == "" {
+		media.Author = status.Account.Username
+	}
+	media.AuthorURL = status.Account.URL
+	setDescription(media, richTextFromHTML(status.Content, status.Account.URL))
+	media.AltText = attachment.Description
+	media.Sensitive = status.Sensitive || status.SpoilerText != ""
+	media.ContentWarning = status.SpoilerText
+}
+
+func (s MastodonService) fileName(status *MastodonStatus, index int, mediaURL string) string {
+	urlParts := strings.Split(mediaURL, "/")
+	fileName := urlParts[len(urlParts)-1]
+	if idx := strings.Index(fileName, "?"); idx != -1 {
+		fileName = fileName[:idx]
+	}
+
+	return fmt.Sprintf("%s_%d_%s", status.ID, index+1, fileName)
+}
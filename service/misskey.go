@@ -10,7 +10,6 @@ import (
 	"strings"
 
 	log "github.com/sirupsen/logrus"
-	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
 type MisskeyService struct {
@@ -20,30 +19,38 @@ type MisskeyService struct {
 }
 
 type NoteFile struct {
-	ID   string
-	Name string
-	Type string
-	URL  string
+	ID          string
+	Name        string
+	Type        string
+	URL         string
+	IsSensitive bool
 }
 
 type NoteUser struct {
 	ID       string
 	Name     string
 	Username string
+	Host     *string
 }
 
 type Note struct {
-	ID    string
-	Text  string
-	User  NoteUser
-	Files []NoteFile
+	ID     string
+	Text   string
+	CW     *string
+	User   NoteUser
+	Files  []NoteFile
+	Renote *Note
 }
 
+// Well known instances, skip the nodeinfo lookup for them
+var misskeyKnownHosts = []string{"misskey.io", "misskey.design"}
+
 func NewMisskeyService() *MisskeyService {
 	return &MisskeyService{
 		Service:   Misskey,
-		urlRegexp: regexp.MustCompile(`(?i)(https?:\/\/misskey\.(?:io|design))\/notes\/(\w+)`),
-		client:    &http.Client{},
+		urlRegexp: regexp.MustCompile(`(?i)(https?:\/\/([\w.-]+))\/notes\/(\w+)`),
+		// instances are whatever host was submitted
+		client: newPublicClient(0),
 	}
 }
 
@@ -53,20 +60,57 @@ func (s MisskeyService) CheckValid(urlString string) (*IncomingURL, bool) {
 		return nil, false
 	}
 
+	if !s.isMisskeyHost(match[2]) {
+		return nil, false
+	}
+
+	return &IncomingURL{
+		Service:  s.Service,
+		Original: urlString,
+		URL:      match[0],
+		Host:     match[1],
+		StrID:    match[3],
+		IntID:    0,
+	}, true
+}
+
+// CheckValidOffline only matches the known instances
+func (s MisskeyService) CheckValidOffline(urlString string) (*IncomingURL, bool) {
+	match := s.urlRegexp.FindStringSubmatch(urlString)
+	if match == nil || !containsString(misskeyKnownHosts, strings.ToLower(match[2])) {
+		return nil, false
+	}
+
 	return &IncomingURL{
 		Service:  s.Service,
 		Original: urlString,
 		URL:      match[0],
 		Host:     match[1],
-		StrID:    match[2],
+		StrID:    match[3],
 		IntID:    0,
 	}, true
 }
 
+func (s MisskeyService) isMisskeyHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, knownHost := range misskeyKnownHosts {
+		if host == knownHost {
+			return true
+		}
+	}
+
+	return GetNodeInfoResolver().IsSoftware(host, misskeySoftware)
+}
+
 func (s MisskeyService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
+// Identity includes the host, note ids are only unique per instance
+func (s MisskeyService) Identity(incomingURL *IncomingURL) string {
+	return fmt.Sprintf("misskey:%s/%s", identityHost(incomingURL.Host), incomingURL.StrID)
+}
+
 func (s MisskeyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error) {
 	var result []*Media
 	id := incomingURL.StrID
@@ -79,7 +123,6 @@ func (s MisskeyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/notes/show", incomingURL.Host), bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/111.0.0.0 Safari/537.36")
-	req.Header.Set("Host", "misskey.io")
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -112,6 +155,13 @@ func (s MisskeyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 		}).Error("Get Misskey info failed")
 	}
 
+	source := incomingURL.URL
+	// pure renote, use the original note instead
+	if len(note.Files) == 0 && note.Renote != nil {
+		note = *note.Renote
+		source = fmt.Sprintf("%s/notes/%s", incomingURL.Host, note.ID)
+	}
+
 	if len(note.Files) == 0 {
 		return result, nil
 	}
@@ -121,7 +171,7 @@ func (s MisskeyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 		fileType := strings.Split(file.Type, "/")[0]
 
 		if file.Type == "image/gif" {
-			resultMedia = s.extractGifAnimation(&file)
+			resultMedia = s.extractAnimation(&file)
 		} else {
 			switch fileType {
 			case "image":
@@ -135,7 +185,8 @@ func (s MisskeyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 
 		if resultMedia != nil {
 			resultMedia.Service = string(s.Service)
-			resultMedia.Source = incomingURL.URL
+			resultMedia.Source = source
+			resultMedia.Sensitive = file.IsSensitive || note.CW != nil
 			s.completeMediaMeta(resultMedia, &note, incomingURL.Host)
 			result = append(result, resultMedia)
 		}
@@ -146,8 +197,19 @@ func (s MisskeyService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 
 func (s MisskeyService) completeMediaMeta(media *Media, note *Note, host string) {
 	media.Author = note.User.Name
-	media.AuthorURL = fmt.Sprintf("%s/@%s", host, note.User.Username)
-	media.Description = note.Text
+	if media.Author == "" {
+		media.Author = note.User.Username
+	}
+	// remote user, link to the profile known by this instance
+	if note.User.Host != nil {
+		media.AuthorURL = fmt.Sprintf("%s/@%s@%s", host, note.User.Username, *note.User.Host)
+	} else {
+		media.AuthorURL = fmt.Sprintf("%s/@%s", host, note.User.Username)
+	}
+	setDescription(media, richTextFromMFM(note.Text, host))
+	if note.CW != nil {
+		media.ContentWarning = *note.CW
+	}
 }
 
 func (s MisskeyService) extractPhoto(file *NoteFile) *Media {
@@ -166,90 +228,11 @@ func (s MisskeyService) extractVideo(file *NoteFile) *Media {
 	}
 }
 
-// func (s MisskeyService) extractAnimation(file *NoteFile) *Media {
-// 	return &Media{
-// 		FileName: file.Name,
-// 		URL:      file.URL,
-// 		Type:     "animation",
-// 	}
-// }
-
-func (s MisskeyService) extractGifAnimation(file *NoteFile) *Media {
-	urlParts := strings.Split(file.URL, "/")
-	actualFileName := urlParts[len(urlParts)-1]
-
-	httpClient := &http.Client{}
-	req, err := http.NewRequest("GET", file.URL, nil)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Get misskey gif failed")
-		return nil
-	}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Get misskey gif failed")
-		return nil
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Get misskey gif failed")
-		return nil
-	}
-
-	defer resp.Body.Close()
-
-	tempFile, err := ioutil.TempFile("", actualFileName+".*.gif")
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Open temp file failed")
-		return nil
-	}
-	defer tempFile.Close()
-
-	_, err = tempFile.Write(body)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Write to temp file failed")
-		return nil
-	}
-
-	filePath := tempFile.Name()
-	newFilePath := filePath + ".mp4"
-
-	err = ffmpeg.Input(filePath, ffmpeg.KwArgs{}).
-		Output(newFilePath, ffmpeg.KwArgs{"c:v": "libx264", "pix_fmt": "yuv420p", "vf": "pad=ceil(iw/2)*2:ceil(ih/2)*2,scale=640:-1"}).
-		OverWriteOutput().
-		ErrorToStdOut().
-		Run()
-
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Convert misskey gif failed")
-		return nil
-	}
-
-	buf, err := ioutil.ReadFile(newFilePath)
-
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Read converted misskey mp4 failed")
-		return nil
-	}
-
+// gifs are turned into mp4 by the transcoder before Telegram gets them
+func (s MisskeyService) extractAnimation(file *NoteFile) *Media {
 	return &Media{
-		FileName: strings.Split(file.Name, ".")[0] + ".mp4",
+		FileName: file.Name,
 		URL:      file.URL,
-		File:     &buf,
 		Type:     "animation",
 	}
 }
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// Moderation decisions, shown on the preview once made
+const (
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+)
+
+// ReplaceDescription sets the caption text a moderator wrote on every media of a submission
+func ReplaceDescription(mediaList []*Media, text string) {
+	for _, media := range mediaList {
+		setDescription(media, RichText{{Text: text}})
+	}
+}
+
+// SendModerationPreview sends the first media of a submission to the moderator chat as it would be posted,
+// with approve, reject and edit caption buttons. Returns the preview message id
+func (s TelegramService) SendModerationPreview(chatID int64, mediaList []*Media, submitter string, pendingID uint64) (int, error) {
+	if len(mediaList) == 0 {
+		return 0, errors.New("nothing to preview")
+	}
+
+	keyboardMarkup := s.moderationKeyboard(pendingID)
+	target := sendTarget{
+		chat:     strconv.FormatInt(chatID, 10),
+		spoiler:  mediaList[0].Sensitive,
+		caption:  s.moderationCaption(mediaList, submitter, ""),
+		embed:    true,
+		keyboard: &keyboardMarkup,
+	}
+
+	message, err := s.sendMedia(mediaList[0], target)
+	if err == nil && message.MessageID == 0 {
+		err = fmt.Errorf("media type %s can't be previewed", mediaList[0].Type)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"chat":  chatID,
+			"url":   mediaList[0].URL,
+			"error": err,
+		}).Error("Send moderation preview failed")
+		return 0, err
+	}
+
+	return message.MessageID, nil
+}
+
+// UpdateModerationPreview re-renders the preview caption after a caption edit, or closes it with the
+// decision when decision is not empty
+func (s TelegramService) UpdateModerationPreview(chatID int64, messageID int, mediaList []*Media, submitter string, pendingID uint64, decision string, moderator string) {
+	if len(mediaList) == 0 {
+		return
+	}
+
+	var decisionLine string
+	if decision != "" {
+		decisionLine = escape(Translate(s.language, "moderation."+decision, moderator))
+	}
+	config := tgbotapi.NewEditMessageCaption(chatID, messageID, s.moderationCaption(mediaList, submitter, decisionLine))
+	config.ParseMode = "MarkdownV2"
+	if decision == "" {
+		keyboardMarkup := s.moderationKeyboard(pendingID)
+		config.ReplyMarkup = &keyboardMarkup
+	}
+
+	s.scheduler.Post(chatKey(chatID, ""), fmt.Sprintf("preview_%d", messageID), func() error {
+		_, err := s.bot.Send(config)
+
+		if err != nil && strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		if err != nil && floodWait(err) == 0 {
+			jsonByte, _ := json.Marshal(config)
+			log.WithFields(log.Fields{
+				"config": string(jsonByte),
+				"error":  err,
+			}).Error("Update moderation preview failed")
+		}
+
+		return err
+	})
+}
+
+// SendCaptionPrompt asks the moderator for a new caption, the reply to the prompt replaces the description
+func (s TelegramService) SendCaptionPrompt(chatID int64, messageID int, lang string) (int, error) {
+	config := tgbotapi.NewMessage(chatID, Translate(lang, "moderation.caption_prompt"))
+	config.ReplyToMessageID = messageID
+	config.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	message, err := s.send(config)
+
+	if err != nil {
+		jsonByte, _ := json.Marshal(config)
+		log.WithFields(log.Fields{
+			"config": string(jsonByte),
+			"error":  err,
+		}).Error("Send caption prompt failed")
+		return 0, err
+	}
+
+	return message.MessageID, nil
+}
+
+func (s TelegramService) moderationKeyboard(pendingID uint64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.approve"), fmt.Sprintf("approve_%d", pendingID)),
+			tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.reject"), fmt.Sprintf("reject_%d", pendingID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.caption"), fmt.Sprintf("caption_%d", pendingID)),
+		),
+	)
+}
+
+// moderationCaption is the caption the first media would be posted with in its channel, headed by the
+// submission and the decision line when they fit
+func (s TelegramService) moderationCaption(mediaList []*Media, submitter string, decisionLine string) string {
+	media := mediaList[0]
+	chat := s.channelName
+	if target, ok := s.targetFor(media); ok {
+		chat = target.chat
+	}
+	caption, _ := s.captions.Render(media, chat)
+
+	header := escape(Translate(s.language, "moderation.preview", len(mediaList), submitter))
+	if decisionLine != "" {
+		header = decisionLine + "\n" + header
+	}
+	if withHeader := header + "\n\n" + caption; captionLength(withHeader) <= telegramCaptionLimit {
+		return withHeader
+	}
+	if decisionLine != "" {
+		return decisionLine
+	}
+	return caption
+}
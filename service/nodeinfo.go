@@ -0,0 +1,232 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const nodeInfoTTL = 24 * time.Hour
+const nodeInfoFailureTTL = 10 * time.Minute
+
+// nodeinfo is looked up while matching urls, a slow host must not hold the webhook
+const nodeInfoTimeout = 3 * time.Second
+
+// nodeinfo documents are small, anything larger isn't one
+const nodeInfoSizeLimit = 64 * 1024
+
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// newPublicClient returns a client that only connects to public addresses. Hosts of fediverse urls come
+// from whoever submitted them, they must not reach the server's own network. The check runs on the
+// resolved address of every connection, redirects included
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// Special purpose ranges the net package doesn't flag, often routed to internal hosts
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved
+	"64:ff9b::/96",   // NAT64, maps to any IPv4 address
+	"64:ff9b:1::/48", // local-use NAT64
+	"2002::/16",      // 6to4, embeds an IPv4 address
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Software names reported by nodeinfo for Misskey and its forks
+var misskeySoftware = []string{"misskey", "sharkey", "firefish", "calckey", "foundkey", "cherrypick", "iceshrimp", "meisskey"}
+
+type nodeInfoLinks struct {
+	Links []struct {
+		Rel  string
+		Href string
+	}
+}
+
+type nodeInfo struct {
+	Software struct {
+		Name    string
+		Version string
+	}
+}
+
+type nodeInfoEntry struct {
+	software string
+	expires  time.Time
+}
+
+// NodeInfoResolver looks up which fediverse software a host runs via
+// /.well-known/nodeinfo and caches the answer per host
+type NodeInfoResolver struct {
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]nodeInfoEntry
+}
+
+var nodeInfoResolverInstance *NodeInfoResolver
+var nodeInfoOnce sync.Once
+
+func GetNodeInfoResolver() *NodeInfoResolver {
+	nodeInfoOnce.Do(func() {
+		nodeInfoResolverInstance = &NodeInfoResolver{
+			client: newPublicClient(nodeInfoTimeout),
+			cache:  make(map[string]nodeInfoEntry),
+		}
+	})
+	return nodeInfoResolverInstance
+}
+
+// Software returns the lowercased software name of the host, empty if unknown
+func (r *NodeInfoResolver) Software(host string) string {
+	host = strings.ToLower(host)
+
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.software
+	}
+
+	software, err := r.fetch(host)
+	ttl := nodeInfoTTL
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":  host,
+			"error": err,
+		}).Debug("Get nodeinfo failed")
+		ttl = nodeInfoFailureTTL
+	}
+
+	r.mu.Lock()
+	r.cache[host] = nodeInfoEntry{software: software, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+
+	return software
+}
+
+// IsSoftware reports whether the host runs any of the given software
+func (r *NodeInfoResolver) IsSoftware(host string, names []string) bool {
+	software := r.Software(host)
+	if software == "" {
+		return false
+	}
+
+	for _, name := range names {
+		if software == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *NodeInfoResolver) fetch(host string) (string, error) {
+	var links nodeInfoLinks
+	if err := r.getJSON(fmt.Sprintf("https://%s/.well-known/nodeinfo", host), &links); err != nil {
+		return "", err
+	}
+
+	// prefer the newest schema, they are listed in ascending order in most servers
+	href := ""
+	for _, link := range links.Links {
+		if strings.HasPrefix(link.Rel, "http://nodeinfo.diaspora.software/ns/schema/") {
+			href = link.Href
+		}
+	}
+	if href == "" {
+		return "", fmt.Errorf("no nodeinfo schema link")
+	}
+	// only follow the document on the host itself
+	if link, err := url.Parse(href); err != nil || link.Scheme != "https" || !strings.EqualFold(link.Hostname(), host) {
+		return "", fmt.Errorf("nodeinfo link off host: %s", href)
+	}
+
+	var info nodeInfo
+	if err := r.getJSON(href, &info); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(info.Software.Name), nil
+}
+
+func (r *NodeInfoResolver) getJSON(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, nodeInfoSizeLimit))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
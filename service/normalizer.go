@@ -0,0 +1,251 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const shortenerCacheTTL = 24 * time.Hour
+const shortenerCacheLimit = 4096
+const shortenerMaxHops = 5
+
+var defaultShorteners = []string{"t.co", "pixiv.me", "bit.ly", "tinyurl.com", "goo.gl", "ow.ly", "buff.ly", "is.gd", "t.ly", "dlvr.it", "tmblr.co"}
+
+// First-party alternate hosts, matched exactly so unrelated subdomains are left alone
+var aliasHosts = map[string]string{
+	"twitter.com":        "x.com",
+	"www.twitter.com":    "x.com",
+	"mobile.twitter.com": "x.com",
+	"mobile.x.com":       "x.com",
+	"www.x.com":          "x.com",
+	"pixiv.net":          "www.pixiv.net",
+	"touch.pixiv.net":    "www.pixiv.net",
+	"instagram.com":      "www.instagram.com",
+	"m.instagram.com":    "www.instagram.com",
+}
+
+// Mirror and embed-fixer domains, matched against the host and all its parent domains
+var mirrorHosts = map[string]string{
+	"fxtwitter.com":   "x.com",
+	"vxtwitter.com":   "x.com",
+	"fixupx.com":      "x.com",
+	"fixvx.com":       "x.com",
+	"twittpr.com":     "x.com",
+	"phixiv.net":      "www.pixiv.net",
+	"ppxiv.net":       "www.pixiv.net",
+	"ddinstagram.com": "www.instagram.com",
+	"kkinstagram.com": "www.instagram.com",
+}
+
+// Query parameters that only track the sharer, dropped on every host
+var trackingParams = []string{"fbclid", "gclid", "dclid", "yclid", "igshid", "igsh", "mibextid", "ref_src", "ref_url", "si", "_ga", "mc_cid", "mc_eid"}
+
+// Query parameters that only track the sharer on specific hosts
+var hostTrackingParams = map[string][]string{
+	"x.com":             {"s", "t", "src", "ref"},
+	"www.instagram.com": {"img_index", "hl"},
+	"bsky.app":          {"ref"},
+}
+
+// pixiv prefixes the path with the UI language, e.g. /en/artworks/123
+var pixivLangPathRegexp = regexp.MustCompile(`^/(?:en|ja|ko|zh|zh-tw|zh-cn)/`)
+
+type shortenerEntry struct {
+	url     string
+	expires time.Time
+}
+
+// URLNormalizer rewrites incoming URLs into the canonical form providers match against
+type URLNormalizer struct {
+	client     *http.Client
+	shorteners map[string]bool
+	mu         sync.Mutex
+	cache      map[string]shortenerEntry
+}
+
+func NewURLNormalizer() *URLNormalizer {
+	shorteners := make(map[string]bool)
+	for _, host := range append(defaultShorteners, viper.GetStringSlice("normalizer.shorteners")...) {
+		shorteners[strings.ToLower(host)] = true
+	}
+
+	return &URLNormalizer{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// follow redirects by hand, we stop as soon as we leave the shorteners
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		shorteners: shorteners,
+		cache:      make(map[string]shortenerEntry),
+	}
+}
+
+// Normalize expands short links, maps mirror domains to the origin and strips tracking
+// parameters. The input is returned unchanged when it is not a valid URL
+func (n *URLNormalizer) Normalize(urlString string) string {
+	return n.normalize(urlString, true)
+}
+
+// NormalizeOffline is Normalize without expanding short links, it makes no network call
+func (n *URLNormalizer) NormalizeOffline(urlString string) string {
+	return n.normalize(urlString, false)
+}
+
+func (n *URLNormalizer) normalize(urlString string, expand bool) string {
+	u, err := url.Parse(strings.TrimSpace(urlString))
+	if err != nil || u.Host == "" {
+		return urlString
+	}
+
+	if expand && n.shorteners[strings.ToLower(u.Hostname())] {
+		if expanded, err := url.Parse(n.expand(u.String())); err == nil && expanded.Host != "" {
+			u = expanded
+		}
+	}
+
+	host := canonicalHost(u.Hostname())
+	port := u.Port()
+	u.Scheme = "https"
+	u.Host = host
+	if port != "" && port != "443" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	u.Fragment = ""
+
+	if host == "www.pixiv.net" {
+		u.Path = pixivLangPathRegexp.ReplaceAllString(u.Path, "/")
+	}
+
+	query := u.Query()
+	for key := range query {
+		lowerKey := strings.ToLower(key)
+		if strings.HasPrefix(lowerKey, "utm_") || containsString(trackingParams, lowerKey) || containsString(hostTrackingParams[host], lowerKey) {
+			query.Del(key)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	result := u.String()
+	if result != urlString {
+		log.WithFields(log.Fields{
+			"original":   urlString,
+			"normalized": result,
+		}).Debug("Normalized url")
+	}
+
+	return result
+}
+
+// expand follows redirects while they stay on shortener hosts, results are cached
+func (n *URLNormalizer) expand(urlString string) string {
+	n.mu.Lock()
+	entry, ok := n.cache[urlString]
+	n.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.url
+	}
+
+	current := urlString
+	for hop := 0; hop < shortenerMaxHops; hop++ {
+		next, err := n.nextLocation(current)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   current,
+				"error": err,
+			}).Warn("Expand short url failed")
+			// don't cache failures, the shortener may be back later
+			return current
+		}
+		if next == "" {
+			break
+		}
+		current = next
+
+		if u, err := url.Parse(current); err != nil || !n.shorteners[strings.ToLower(u.Hostname())] {
+			break
+		}
+	}
+
+	n.mu.Lock()
+	if len(n.cache) >= shortenerCacheLimit {
+		n.cache = make(map[string]shortenerEntry)
+	}
+	n.cache[urlString] = shortenerEntry{url: current, expires: time.Now().Add(shortenerCacheTTL)}
+	n.mu.Unlock()
+
+	return current
+}
+
+// nextLocation returns the redirect target of the URL, empty if it doesn't redirect
+func (n *URLNormalizer) nextLocation(urlString string) (string, error) {
+	req, err := http.NewRequest("HEAD", urlString, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	// some shorteners don't answer HEAD
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		req.Method = "GET"
+		resp, err = n.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return "", nil
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", err
+	}
+
+	return location.String(), nil
+}
+
+func canonicalHost(host string) string {
+	host = strings.ToLower(host)
+	if canonical, ok := aliasHosts[host]; ok {
+		return canonical
+	}
+	// match subdomains too, e.g. d.fxtwitter.com
+	for candidate := host; candidate != ""; {
+		if canonical, ok := mirrorHosts[candidate]; ok {
+			return canonical
+		}
+		idx := strings.Index(candidate, ".")
+		if idx == -1 {
+			break
+		}
+		candidate = candidate[idx+1:]
+	}
+
+	return host
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -80,6 +80,10 @@ func (s PixivService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
+func (s PixivService) Identity(incomingURL *IncomingURL) string {
+	return "pixiv:" + incomingURL.StrID
+}
+
 func (s PixivService) GetIDFromURL(url string) int {
 	match := s.urlRegexp.FindStringSubmatch(url)
 	if match == nil {
@@ -232,9 +236,14 @@ func (s PixivService) ExtractMediaFromURL(incomingURL *IncomingURL) (result []*M
 	return result, nil
 }
 
+const pixivSensitiveSanityLevel = 6
+
 func (s PixivService) completeMediaMeta(media *Media, illust *pixiv.GetIllustDetailIllust) {
 	media.Author = illust.User.Name
 	media.AuthorURL = pixivAuthorPrefix + strconv.Itoa(illust.User.ID)
 	media.Title = illust.Title
-	media.Description = illust.Caption
+	// captions are HTML, links to other sites go through jump.php
+	setDescription(media, richTextFromHTML(illust.Caption, "https://www.pixiv.net/"))
+	// x_restrict is 1 for R-18 and 2 for R-18G, sanity_level 6 is what pixiv blurs for logged out users
+	media.Sensitive = illust.XRestrict > 0 || illust.SanityLevel >= pixivSensitiveSanityLevel
 }
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/wxt2005/image-capture-bot-go/db"
+)
+
+// PostRefOf describes a sent message, with its file and caption so it can be posted again
+func PostRefOf(message *tgbotapi.Message) db.PostRef {
+	post := db.PostRef{
+		ChatID:       message.Chat.ID,
+		ChatUserName: message.Chat.UserName,
+		MessageID:    message.MessageID,
+		Date:         message.Time(),
+	}
+	post.FileID, post.FileType = postFile(message)
+	post.Caption = message.Caption
+	if len(message.CaptionEntities) > 0 {
+		post.CaptionEntities, _ = json.Marshal(message.CaptionEntities)
+	}
+
+	return post
+}
+
+// ForwardedPost describes the channel message a forwarded message came from, false if it wasn't
+// forwarded from a channel. The file id is the one of the forwarded copy, usable by the bot all the same
+func ForwardedPost(message *tgbotapi.Message) (db.PostRef, bool) {
+	if message == nil || message.ForwardFromChat == nil || message.ForwardFromMessageID == 0 {
+		return db.PostRef{}, false
+	}
+
+	post := PostRefOf(message)
+	post.ChatID = message.ForwardFromChat.ID
+	post.ChatUserName = message.ForwardFromChat.UserName
+	post.MessageID = message.ForwardFromMessageID
+	post.Date = time.Unix(int64(message.ForwardDate), 0)
+
+	return post, true
+}
+
+// postFile is the file id and type of the media of a message, empty for text
+func postFile(message *tgbotapi.Message) (string, string) {
+	switch {
+	case message.Animation != nil:
+		return message.Animation.FileID, "animation"
+	case message.Video != nil:
+		return message.Video.FileID, "video"
+	case len(message.Photo) > 0:
+		return getLargestPhoto(message).FileID, "photo"
+	case message.Document != nil:
+		return message.Document.FileID, "document"
+	}
+	return "", ""
+}
+
+// DeleteMessages deletes messages of a chat, all of them are tried and the first error is returned
+func (s TelegramService) DeleteMessages(chatID int64, messageIDs ...int) error {
+	var firstErr error
+	for _, messageID := range messageIDs {
+		config := tgbotapi.NewDeleteMessage(chatID, messageID)
+		if _, err := s.request(config); err != nil {
+			log.WithFields(log.Fields{
+				"chat":    chatID,
+				"message": messageID,
+				"error":   err,
+			}).Error("Delete message failed")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// EditPostCaption replaces the caption of a post with plain text, keeping its like button and the count
+// of its primary. Album photos have no button
+func (s TelegramService) EditPostCaption(post db.PostRef, caption string, likeCount int) (db.PostRef, error) {
+	config := tgbotapi.NewEditMessageCaption(post.ChatID, post.MessageID, caption)
+	primary, withButton := post.MessageID, true
+	if link, err := db.FindPostLink(post.ChatID, post.MessageID); err == nil && link != nil {
+		primary = link.Primary
+		withButton = containsInt(link.Buttons, post.MessageID)
+	}
+	if withButton {
+		keyboardMarkup := s.likeKeyboard(post.MessageID, primary, likeCount)
+		config.ReplyMarkup = &keyboardMarkup
+	}
+
+	message, err := s.send(config)
+	if err != nil {
+		jsonByte, _ := json.Marshal(config)
+		log.WithFields(log.Fields{
+			"config": string(jsonByte),
+			"error":  err,
+		}).Error("Edit post caption failed")
+		return post, err
+	}
+
+	if message.Chat == nil {
+		post.Caption = caption
+		post.CaptionEntities = nil
+		return post, nil
+	}
+	return PostRefOf(&message), nil
+}
+
+// RepostFile posts a post again in chat by its file ids, with the same caption and a new like button.
+// Albums are rebuilt with the like button in a reply, as sendSlices does. The new post is recorded
+// against identity
+func (s TelegramService) RepostFile(post db.PostRef, chat string, identity string) (tgbotapi.Message, error) {
+	if link, err := db.FindPostLink(post.ChatID, post.MessageID); err == nil && link != nil && len(link.Album) > 0 {
+		return s.repostAlbum(link.Album, chat, identity)
+	}
+	if post.FileID == "" {
+		return tgbotapi.Message{}, fmt.Errorf("post %d has no file", post.MessageID)
+	}
+
+	method := map[string]string{
+		"photo":     "sendPhoto",
+		"video":     "sendVideo",
+		"animation": "sendAnimation",
+		"document":  "sendDocument",
+	}[post.FileType]
+
+	params := tgbotapi.Params{}
+	params.AddNonEmpty("chat_id", chat)
+	params.AddNonEmpty("caption", post.Caption)
+	if len(post.CaptionEntities) > 0 {
+		params["caption_entities"] = string(post.CaptionEntities)
+	}
+	likeButton := tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.like"), s.likeBtnAction)
+	if err := params.AddInterface("reply_markup", tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(likeButton))); err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	files := []tgbotapi.RequestFile{{Name: post.FileType, Data: tgbotapi.FileID(post.FileID)}}
+	resp, err := s.uploadFiles(method, params, files, 1)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"chat":     chat,
+			"identity": identity,
+			"error":    err,
+		}).Error("Repost file failed")
+		return tgbotapi.Message{}, err
+	}
+
+	var message tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &message); err != nil {
+		return message, err
+	}
+	s.recordPost(&Media{Identity: identity}, &message)
+
+	return message, nil
+}
+
+// repostAlbum sends the photos of an album post again with sendMediaGroup, the like button goes in a
+// reply under the first album
+func (s TelegramService) repostAlbum(album []db.PostRef, chat string, identity string) (tgbotapi.Message, error) {
+	var first *tgbotapi.Message
+	var albumIDs []int
+	var newAlbum []db.PostRef
+
+	for start := 0; start < len(album); start += telegramAlbumSize {
+		end := start + telegramAlbumSize
+		if end > len(album) {
+			end = len(album)
+		}
+
+		var items []interface{}
+		for _, photo := range album[start:end] {
+			item := tgbotapi.NewInputMediaPhoto(tgbotapi.FileID(photo.FileID))
+			item.Caption = photo.Caption
+			if len(photo.CaptionEntities) > 0 {
+				json.Unmarshal(photo.CaptionEntities, &item.CaptionEntities)
+			}
+			items = append(items, item)
+		}
+
+		config := tgbotapi.MediaGroupConfig{ChannelUsername: chat, Media: items}
+		if first != nil {
+			config.ReplyToMessageID = first.MessageID
+		}
+		messages, err := s.sendMediaGroup(config)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"chat":     chat,
+				"identity": identity,
+				"error":    err,
+			}).Error("Repost album failed")
+			return tgbotapi.Message{}, err
+		}
+		if first == nil && len(messages) > 0 {
+			first = &messages[0]
+		}
+		for i := range messages {
+			albumIDs = append(albumIDs, messages[i].MessageID)
+			newAlbum = append(newAlbum, PostRefOf(&messages[i]))
+		}
+	}
+
+	if first == nil {
+		return tgbotapi.Message{}, errors.New("no album photo sent")
+	}
+
+	likeButton := tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.like"), s.likeBtnAction)
+	config := tgbotapi.NewMessageToChannel(chat, Translate(s.language, "slices.notice", len(album)))
+	config.ReplyToMessageID = first.MessageID
+	config.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(likeButton))
+
+	message, err := s.send(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"chat":     chat,
+			"identity": identity,
+			"error":    err,
+		}).Error("Repost album like button failed")
+		return message, err
+	}
+
+	s.linkPost(message.Chat.ID, message.MessageID, identity, false, albumIDs...)
+	if err := db.SetPostAlbum(message.Chat.ID, message.MessageID, newAlbum); err != nil {
+		log.WithFields(log.Fields{
+			"identity": identity,
+			"error":    err,
+		}).Error("Record post album failed")
+	}
+	s.recordPost(&Media{Identity: identity}, &message)
+
+	return message, nil
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// Telegram thumbnails are JPEG, at most 320px on each side
+const thumbnailSize = 320
+
+type probeStream struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	PixFmt    string `json:"pix_fmt"`
+	Width     int
+	Height    int
+	Tags      struct {
+		Rotate string
+	}
+	SideDataList []struct {
+		Rotation int
+	} `json:"side_data_list"`
+}
+
+type probeResult struct {
+	Streams []probeStream
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string
+		Size       string
+	}
+}
+
+func (p *probeResult) stream(codecType string) *probeStream {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == codecType {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+func (p *probeResult) duration() float64 {
+	duration, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return duration
+}
+
+// playable reports if Telegram plays the file inline as it is
+func (p *probeResult) playable() bool {
+	video := p.stream("video")
+	if video == nil || video.CodecName != "h264" || video.PixFmt != "yuv420p" {
+		return false
+	}
+	if audio := p.stream("audio"); audio != nil && audio.CodecName != "aac" && audio.CodecName != "mp3" {
+		return false
+	}
+	return strings.Contains(p.Format.FormatName, "mp4")
+}
+
+// dimension is the size the video is displayed at, phones store portrait videos rotated
+func (p *probeResult) dimension() (width int, height int) {
+	video := p.stream("video")
+	if video == nil {
+		return 0, 0
+	}
+
+	rotation, _ := strconv.Atoi(video.Tags.Rotate)
+	for _, sideData := range video.SideDataList {
+		if sideData.Rotation != 0 {
+			rotation = sideData.Rotation
+		}
+	}
+	if rotation%180 != 0 {
+		return video.Height, video.Width
+	}
+
+	return video.Width, video.Height
+}
+
+func probeMedia(input string, kwargs ffmpeg.KwArgs) (*probeResult, error) {
+	output, err := ffmpeg.Probe(input, kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := probeResult{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// MediaProber fills dimension, duration and thumbnail of videos and animations, so Telegram shows them
+// in the right shape with a preview
+type MediaProber struct{}
+
+func NewMediaProber() *MediaProber {
+	return &MediaProber{}
+}
+
+func (p MediaProber) Transform(media *Media) (*Media, error) {
+	if (media.Type != "video" && media.Type != "animation") || len(media.TGFileID) != 0 {
+		return media, nil
+	}
+
+	// like the transcoder, ffmpeg only reads files downloaded through the guarded client
+	file := media.File
+	if file == nil {
+		downloaded, err := downloadMedia(media)
+		if err != nil {
+			return media, err
+		}
+		file = &downloaded
+	}
+
+	tempFile, err := os.CreateTemp("", "probe-*"+mediaExtension(media))
+	if err != nil {
+		return media, err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(*file)
+	tempFile.Close()
+	if err != nil {
+		return media, err
+	}
+	input := tempFile.Name()
+
+	probe, err := probeMedia(input, ffmpeg.KwArgs{})
+	if err != nil {
+		return media, err
+	}
+
+	result := *media
+	if width, height := probe.dimension(); width > 0 && height > 0 {
+		result.Width = width
+		result.Height = height
+	}
+	result.Duration = int(math.Round(probe.duration()))
+
+	thumbnail, err := extractThumbnail(input, probe.duration())
+	if err != nil {
+		// a missing preview isn't worth failing the post
+		log.WithFields(log.Fields{
+			"url":   media.URL,
+			"error": err,
+		}).Warn("Extract thumbnail failed")
+	} else {
+		result.Thumbnail = &thumbnail
+	}
+
+	return &result, nil
+}
+
+// extractThumbnail grabs a frame a second in, or from the middle of shorter clips, as a small JPEG
+func extractThumbnail(input string, duration float64) ([]byte, error) {
+	output, err := os.CreateTemp("", "thumbnail-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	output.Close()
+	defer os.Remove(output.Name())
+
+	err = ffmpeg.Input(input, ffmpeg.KwArgs{"ss": strconv.FormatFloat(math.Min(1, duration/2), 'f', 2, 64)}).
+		Output(output.Name(), ffmpeg.KwArgs{
+			"frames:v": 1,
+			"vf":       "scale=w=" + strconv.Itoa(thumbnailSize) + ":h=" + strconv.Itoa(thumbnailSize) + ":force_original_aspect_ratio=decrease",
+			"q:v":      5,
+		}).
+		OverWriteOutput().
+		ErrorToStdOut().
+		Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(output.Name())
+}
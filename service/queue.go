@@ -0,0 +1,436 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/wxt2005/image-capture-bot-go/db"
+)
+
+// How long the queue waits after failing to read itself, and when empty with nothing waking it up
+const queueRetryInterval = time.Minute
+const queueIdleInterval = time.Hour
+
+// Failed posts of an item before it is dropped
+const queueMaxAttempts = 3
+
+// PostQueue drip-feeds content into channels. Every channel has its own queue, posting one content per
+// interval and nothing during quiet hours. Queues live in bbolt, a restart picks up where it left
+type PostQueue struct {
+	// channel of media without one
+	channel  string
+	schedule queueSchedule
+	// schedules set in telegram.queue.channels, by lowercased channel
+	schedules map[string]queueSchedule
+	location  *time.Location
+	wake      chan struct{}
+	// one post at a time, /now and the schedule could otherwise post the same item
+	postMu sync.Mutex
+}
+
+// queueSchedule is how a channel's queue posts
+type queueSchedule struct {
+	interval time.Duration
+	// quiet hours in minutes of the day, equal for none
+	quietStart int
+	quietEnd   int
+}
+
+var errQueueEmpty = errors.New("no queued item at position")
+
+// queuedMedia keeps the Media fields left out of JSON, the queue needs them to post later
+type queuedMedia struct {
+	*Media
+	TGFileID        string   `json:"tg_file_id,omitempty"`
+	SendOriginal    bool     `json:"send_original,omitempty"`
+	RichDescription RichText `json:"rich_description,omitempty"`
+	Channel         string   `json:"channel,omitempty"`
+}
+
+// MarshalMediaList stores media for posting later, with the fields Media leaves out of JSON
+func MarshalMediaList(mediaList []*Media) (json.RawMessage, error) {
+	var queued []queuedMedia
+	for _, media := range mediaList {
+		queued = append(queued, queuedMedia{Media: media, TGFileID: media.TGFileID, SendOriginal: media.SendOriginal, RichDescription: media.RichDescription, Channel: media.Channel})
+	}
+	return json.Marshal(queued)
+}
+
+func UnmarshalMediaList(value json.RawMessage) ([]*Media, error) {
+	var queued []queuedMedia
+	if err := json.Unmarshal(value, &queued); err != nil {
+		return nil, err
+	}
+
+	var mediaList []*Media
+	for _, entry := range queued {
+		if entry.Media == nil {
+			continue
+		}
+		entry.Media.TGFileID = entry.TGFileID
+		entry.Media.SendOriginal = entry.SendOriginal
+		entry.Media.RichDescription = entry.RichDescription
+		entry.Media.Channel = entry.Channel
+		mediaList = append(mediaList, entry.Media)
+	}
+	return mediaList, nil
+}
+
+func NewPostQueue() *PostQueue {
+	queue := &PostQueue{
+		channel:   viper.GetString("telegram.channel_name"),
+		schedule:  queueSchedule{interval: viper.GetDuration("telegram.queue.interval")},
+		schedules: make(map[string]queueSchedule),
+		location:  time.Local,
+		wake:      make(chan struct{}, 1),
+	}
+
+	if name := viper.GetString("telegram.queue.timezone"); name != "" {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"timezone": name,
+				"error":    err,
+			}).Error("Load queue timezone failed")
+		} else {
+			queue.location = location
+		}
+	}
+
+	queue.schedule.setQuietHours(viper.GetString("telegram.queue.quiet_hours"))
+
+	// channels may post at their own pace, what they leave out follows the queue settings
+	for channel := range viper.GetStringMap("telegram.queue.channels") {
+		key := "telegram.queue.channels." + channel
+		schedule := queue.schedule
+		if interval := viper.GetDuration(key + ".interval"); interval > 0 {
+			schedule.interval = interval
+		}
+		if viper.IsSet(key + ".quiet_hours") {
+			schedule.setQuietHours(viper.GetString(key + ".quiet_hours"))
+		}
+		queue.schedules[strings.ToLower(channel)] = schedule
+	}
+
+	return queue
+}
+
+// setQuietHours reads quiet hours such as 01:00-08:00, empty for none
+func (s *queueSchedule) setQuietHours(quietHours string) {
+	if quietHours == "" {
+		s.quietStart, s.quietEnd = 0, 0
+		return
+	}
+
+	var startHour, startMinute, endHour, endMinute int
+	_, err := fmt.Sscanf(quietHours, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"quiet_hours": quietHours,
+			"error":       err,
+		}).Error("Parse queue quiet hours failed")
+		return
+	}
+	s.quietStart = startHour*60 + startMinute
+	s.quietEnd = endHour*60 + endMinute
+}
+
+// Enabled is false when telegram.queue.interval is 0, media is then posted right away
+func (q *PostQueue) Enabled() bool {
+	return q.schedule.interval > 0
+}
+
+// queueChannel is the channel a queue belongs to, the default channel when empty
+func (q *PostQueue) queueChannel(channel string) string {
+	if channel == "" {
+		return q.channel
+	}
+	return channel
+}
+
+func (q *PostQueue) scheduleOf(channel string) queueSchedule {
+	if schedule, ok := q.schedules[strings.ToLower(channel)]; ok {
+		return schedule
+	}
+	return q.schedule
+}
+
+// Push queues media in the queue of the channel it goes to, one item per content so the media of a post
+// stay together. Returns the position of the last item in its queue
+func (q *PostQueue) Push(mediaList []*Media, submitter string) (position int, err error) {
+	type group struct {
+		channel string
+		key     string
+	}
+	var order []group
+	groups := make(map[group][]*Media)
+	for i, media := range mediaList {
+		// media without identity came from a forwarded message, keep them apart
+		key := group{channel: q.queueChannel(media.Channel), key: media.Identity}
+		if key.key == "" {
+			key.key = fmt.Sprintf("media_%d", i)
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], media)
+	}
+
+	for _, key := range order {
+		value, err := MarshalMediaList(groups[key])
+		if err != nil {
+			return position, err
+		}
+
+		position, err = db.PushQueueItem(key.channel, db.QueueItem{
+			Identity:  groups[key][0].Identity,
+			Media:     value,
+			Submitter: submitter,
+			Added:     time.Now(),
+		})
+		if err != nil {
+			return position, err
+		}
+	}
+
+	q.notify()
+	return position, nil
+}
+
+// Run posts due items through consume until the process ends, sleeping until the next one is due
+func (q *PostQueue) Run(consume func([]*Media) ConsumeResult) {
+	for {
+		timer := time.NewTimer(q.postDue(consume))
+
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		}
+	}
+}
+
+func (q *PostQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// postDue posts the first item of a queue that is due, and returns how long until the next one is
+func (q *PostQueue) postDue(consume func([]*Media) ConsumeResult) time.Duration {
+	channels, err := db.QueueChannels()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("List post queues failed")
+		return queueRetryInterval
+	}
+
+	wait := queueIdleInterval
+	now := time.Now()
+	for _, channel := range channels {
+		queue, err := db.GetChannelQueue(channel)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"channel": channel,
+				"error":   err,
+			}).Error("Get post queue failed")
+			if queueRetryInterval < wait {
+				wait = queueRetryInterval
+			}
+			continue
+		}
+
+		if len(queue.Items) == 0 {
+			continue
+		}
+		if next := q.NextPost(channel, queue, now); next.After(now) {
+			if next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+			continue
+		}
+
+		if err := q.post(channel, 1, consume); err != nil {
+			log.WithFields(log.Fields{
+				"channel": channel,
+				"error":   err,
+			}).Error("Post queued item failed")
+		}
+		// the post moved the last posted time, look again
+		return 0
+	}
+
+	return wait
+}
+
+// PostNow posts the item at position of the channel's queue right away, whatever the interval and quiet
+// hours say. False if there is no such item
+func (q *PostQueue) PostNow(channel string, position int, consume func([]*Media) ConsumeResult) (bool, error) {
+	err := q.post(q.queueChannel(channel), position, consume)
+	if err == errQueueEmpty {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// post posts the item at position, it leaves the queue once posted. A failed item stays for another try
+// an interval later, and is dropped after queueMaxAttempts
+func (q *PostQueue) post(channel string, position int, consume func([]*Media) ConsumeResult) error {
+	q.postMu.Lock()
+	defer q.postMu.Unlock()
+
+	item, err := db.GetQueueItem(channel, position)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return errQueueEmpty
+	}
+
+	mediaList, err := UnmarshalMediaList(item.Media)
+	if err != nil {
+		// it can never be posted
+		q.drop(channel, item)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"channel":  channel,
+		"identity": item.Identity,
+		"media":    len(mediaList),
+	}).Info("Post queued item")
+	failure := consume(mediaList).RetryErr()
+	if failure == nil {
+		return db.RemoveQueueItem(channel, item.ID, time.Now())
+	}
+
+	attempts, err := db.FailQueueItem(channel, item.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	if attempts >= queueMaxAttempts {
+		q.drop(channel, item)
+	}
+	return fmt.Errorf("post queued item %d, attempt %d: %w", item.ID, attempts, failure)
+}
+
+// drop takes an item that won't be posted out of the queue, its content may be submitted again
+func (q *PostQueue) drop(channel string, item *db.QueueItem) {
+	log.WithFields(log.Fields{
+		"channel":  channel,
+		"identity": item.Identity,
+	}).Error("Drop queued item")
+
+	if err := db.RemoveQueueItem(channel, item.ID, time.Now()); err != nil {
+		log.WithFields(log.Fields{
+			"identity": item.Identity,
+			"error":    err,
+		}).Error("Remove queued item failed")
+	}
+	if item.Identity == "" {
+		return
+	}
+	if err := db.ReleaseURLRecord(item.Identity); err != nil {
+		log.WithFields(log.Fields{
+			"identity": item.Identity,
+			"error":    err,
+		}).Error("Release url record failed")
+	}
+}
+
+// Clear drops every item of the channel's queue and returns them
+func (q *PostQueue) Clear(channel string) ([]db.QueueItem, error) {
+	return db.ClearQueue(q.queueChannel(channel))
+}
+
+func (q *PostQueue) Move(channel string, from int, to int) error {
+	return db.MoveQueueItem(q.queueChannel(channel), from, to)
+}
+
+// NextPost is when the next item of the channel is due: an interval after its last post, pushed past
+// quiet hours
+func (q *PostQueue) NextPost(channel string, queue *db.ChannelQueue, now time.Time) time.Time {
+	schedule := q.scheduleOf(channel)
+	next := queue.LastPosted.Add(schedule.interval)
+	if next.Before(now) {
+		next = now
+	}
+
+	next = next.In(q.location)
+	if schedule.quiet(next) {
+		end := time.Date(next.Year(), next.Month(), next.Day(), schedule.quietEnd/60, schedule.quietEnd%60, 0, 0, q.location)
+		if end.Before(next) {
+			end = end.AddDate(0, 0, 1)
+		}
+		next = end
+	}
+
+	return next
+}
+
+func (s queueSchedule) quiet(t time.Time) bool {
+	if s.quietStart == s.quietEnd {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if s.quietStart < s.quietEnd {
+		return minute >= s.quietStart && minute < s.quietEnd
+	}
+	// spans midnight
+	return minute >= s.quietStart || minute < s.quietEnd
+}
+
+// Describe lists the channel's queue for /queue, followed by the other channels with queued items
+func (q *PostQueue) Describe(channel string, lang string) (string, error) {
+	channel = q.queueChannel(channel)
+	queue, err := db.GetChannelQueue(channel)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	if len(queue.Items) == 0 {
+		lines = append(lines, Translate(lang, "queue.empty", channel))
+	} else {
+		lines = append(lines, Translate(lang, "queue.header", channel, len(queue.Items), q.NextPost(channel, queue, time.Now()).Format("01-02 15:04")))
+	}
+	for i, item := range queue.Items {
+		label := item.Identity
+		if label == "" {
+			label = fmt.Sprintf("#%d", item.ID)
+		}
+		line := fmt.Sprintf("%d. %s", i+1, label)
+		if item.Submitter != "" {
+			line += " · " + item.Submitter
+		}
+		lines = append(lines, line)
+	}
+
+	channels, err := db.QueueChannels()
+	if err != nil {
+		return "", err
+	}
+	var others []string
+	for _, other := range channels {
+		if other == channel {
+			continue
+		}
+		if otherQueue, err := db.GetChannelQueue(other); err == nil && len(otherQueue.Items) > 0 {
+			others = append(others, fmt.Sprintf("%s (%d)", other, len(otherQueue.Items)))
+		}
+	}
+	if len(others) > 0 {
+		lines = append(lines, Translate(lang, "queue.others", strings.Join(others, ", ")))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// RichText is a description with its links, mentions and hashtags resolved to urls. Providers parse
+// their own markup into it, consumers render it into theirs
+type RichText []RichSpan
+
+// RichSpan is a run of text, linking to URL unless it is empty
+type RichSpan struct {
+	Text string
+	URL  string
+}
+
+// setDescription fills both the plain and the rich description of the media
+func setDescription(media *Media, text RichText) {
+	text = text.TrimSpace()
+	media.Description = text.String()
+	media.RichDescription = text
+}
+
+// String is the plain text, links reduced to their text
+func (t RichText) String() string {
+	var builder strings.Builder
+	for _, span := range t {
+		builder.WriteString(span.Text)
+	}
+	return builder.String()
+}
+
+// Markdown renders Telegram MarkdownV2
+func (t RichText) Markdown() string {
+	var builder strings.Builder
+	for _, span := range t {
+		if span.URL == "" {
+			builder.WriteString(escape(span.Text))
+		} else {
+			builder.WriteString("[" + escape(span.Text) + "](" + escapeLink(span.URL) + ")")
+		}
+	}
+	return builder.String()
+}
+
+// HTML renders Telegram HTML
+func (t RichText) HTML() string {
+	var builder strings.Builder
+	for _, span := range t {
+		if span.URL == "" {
+			builder.WriteString(html.EscapeString(span.Text))
+		} else {
+			builder.WriteString(`<a href="` + html.EscapeString(span.URL) + `">` + html.EscapeString(span.Text) + "</a>")
+		}
+	}
+	return builder.String()
+}
+
+// Len is the length of the plain text in runes
+func (t RichText) Len() int {
+	length := 0
+	for _, span := range t {
+		length += len([]rune(span.Text))
+	}
+	return length
+}
+
+// Slice cuts the rune range [start, end) of the plain text, links cut in half keep their url
+func (t RichText) Slice(start int, end int) RichText {
+	var result RichText
+	offset := 0
+	for _, span := range t {
+		runes := []rune(span.Text)
+		from, to := start-offset, end-offset
+		offset += len(runes)
+		if from < 0 {
+			from = 0
+		}
+		if to > len(runes) {
+			to = len(runes)
+		}
+		if from >= to {
+			continue
+		}
+		result = append(result, RichSpan{Text: string(runes[from:to]), URL: span.URL})
+	}
+	return result
+}
+
+// TrimSpace drops leading and trailing white space
+func (t RichText) TrimSpace() RichText {
+	result := append(RichText(nil), t...)
+	for len(result) > 0 && strings.TrimSpace(result[0].Text) == "" {
+		result = result[1:]
+	}
+	for len(result) > 0 && strings.TrimSpace(result[len(result)-1].Text) == "" {
+		result = result[:len(result)-1]
+	}
+	if len(result) > 0 {
+		result[0].Text = strings.TrimLeft(result[0].Text, " \t\r\n")
+		result[len(result)-1].Text = strings.TrimRight(result[len(result)-1].Text, " \t\r\n")
+	}
+	return result
+}
+
+// Split cuts the text into parts of at most limit UTF-16 units, the way Telegram counts message length
+func (t RichText) Split(limit int) []RichText {
+	var parts []RichText
+	runes := []rune(t.String())
+	start, units := 0, 0
+	for i, r := range runes {
+		width := len(utf16.Encode([]rune{r}))
+		if units+width > limit {
+			parts = append(parts, t.Slice(start, i))
+			start, units = i, 0
+		}
+		units += width
+	}
+	if start < len(runes) {
+		parts = append(parts, t.Slice(start, len(runes)))
+	}
+	return parts
+}
+
+// textRange marks a byte range of a text as a link, replaces its text if Text is set, or drops it
+type textRange struct {
+	start int
+	end   int
+	url   string
+	text  string
+	drop  bool
+}
+
+// richTextFromRanges builds rich text from plain text and annotated byte ranges, as given by Bluesky facets
+// or Twitter entities. Overlapping and out of bounds ranges are ignored
+func richTextFromRanges(text string, ranges []textRange) RichText {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	var result RichText
+	position := 0
+	for _, r := range ranges {
+		if r.start < position || r.end > len(text) || r.start >= r.end {
+			continue
+		}
+		if r.start > position {
+			result = append(result, RichSpan{Text: text[position:r.start]})
+		}
+		position = r.end
+		if r.drop {
+			continue
+		}
+		span := RichSpan{Text: text[r.start:r.end], URL: r.url}
+		if r.text != "" {
+			span.Text = r.text
+		}
+		result = append(result, span)
+	}
+	if position < len(text) {
+		result = append(result, RichSpan{Text: text[position:]})
+	}
+
+	return result
+}
+
+var htmlTagRegexp = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)([^>]*)>`)
+var htmlHrefRegexp = regexp.MustCompile(`(?i)href\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// richTextFromHTML parses the HTML of pixiv captions and Mastodon statuses, keeping line breaks and links.
+// Relative links are resolved against base
+func richTextFromHTML(source string, base string) RichText {
+	var result RichText
+	href := ""
+	position := 0
+
+	appendText := func(text string) {
+		if text == "" {
+			return
+		}
+		result = append(result, RichSpan{Text: html.UnescapeString(text), URL: href})
+	}
+
+	for _, match := range htmlTagRegexp.FindAllStringSubmatchIndex(source, -1) {
+		appendText(source[position:match[0]])
+		position = match[1]
+
+		closing := source[match[2]:match[3]] == "/"
+		switch strings.ToLower(source[match[4]:match[5]]) {
+		case "br":
+			result = append(result, RichSpan{Text: "\n"})
+		case "p", "div":
+			if closing {
+				result = append(result, RichSpan{Text: "\n\n"})
+			}
+		case "a":
+			href = ""
+			if !closing {
+				if attr := htmlHrefRegexp.FindStringSubmatch(source[match[6]:match[7]]); attr != nil {
+					href = resolveLink(html.UnescapeString(attr[1]+attr[2]), base)
+				}
+			}
+		}
+	}
+	appendText(source[position:])
+
+	return result
+}
+
+// resolveLink makes a link absolute and unwraps redirect pages such as pixiv's jump.php
+func resolveLink(link string, base string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	if baseURL, err := url.Parse(base); err == nil {
+		parsed = baseURL.ResolveReference(parsed)
+	}
+	if strings.HasSuffix(parsed.Path, "/jump.php") {
+		if target := parsed.Query().Get("url"); target != "" {
+			return target
+		}
+		// old style jump.php?https%3A%2F%2F...
+		if target, err := url.QueryUnescape(parsed.RawQuery); err == nil && strings.Contains(target, "://") {
+			return target
+		}
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ""
+	}
+	return parsed.String()
+}
+
+// MFM decorations that only change the look, their content is kept
+var mfmFunctionRegexp = regexp.MustCompile(`\$\[[^\s\[\]]+ ([^\[\]]*)\]`)
+var mfmStyleRegexp = regexp.MustCompile(`(?s)\*\*\*(.+?)\*\*\*|\*\*(.+?)\*\*|~~(.+?)~~|</?(?:b|i|s|small|center|plain)>`)
+
+// MFM elements that turn into links: [label](url), <url>, bare urls, @user@host mentions and #hashtags
+var mfmLinkRegexp = regexp.MustCompile(`\??\[([^\[\]]+)\]\(<?(https?://[^\s)>]+)>?\)|<(https?://[^\s>]+)>|(https?://[\w\-.~:/?#\[\]@!$&'*+,;=%]+)|(?:^|[^\w@])(@([a-zA-Z0-9_]+)(?:@([a-zA-Z0-9\-.]+[a-zA-Z0-9]))?)|(?:^|[^\w&])(#([^\s.,!?'"#:/\[\]【】()「」（）<>]+))`)
+
+// richTextFromMFM parses Misskey Flavored Markdown, mentions and hashtags link to instance, the base url
+// of the Misskey instance the note was fetched from
+func richTextFromMFM(text string, instance string) RichText {
+	for {
+		stripped := mfmFunctionRegexp.ReplaceAllString(text, "$1")
+		if stripped == text {
+			break
+		}
+		text = stripped
+	}
+	text = mfmStyleRegexp.ReplaceAllString(text, "$1$2$3")
+
+	var ranges []textRange
+	for _, match := range mfmLinkRegexp.FindAllStringSubmatchIndex(text, -1) {
+		switch {
+		case match[2] >= 0:
+			ranges = append(ranges, textRange{start: match[0], end: match[1], url: text[match[4]:match[5]], text: text[match[2]:match[3]]})
+		case match[6] >= 0:
+			ranges = append(ranges, textRange{start: match[0], end: match[1], url: text[match[6]:match[7]], text: text[match[6]:match[7]]})
+		case match[8] >= 0:
+			ranges = append(ranges, textRange{start: match[8], end: match[9], url: text[match[8]:match[9]]})
+		case match[10] >= 0:
+			user := text[match[12]:match[13]]
+			if match[14] >= 0 {
+				user += "@" + text[match[14]:match[15]]
+			}
+			ranges = append(ranges, textRange{start: match[10], end: match[11], url: instance + "/@" + user})
+		case match[16] >= 0:
+			ranges = append(ranges, textRange{start: match[16], end: match[17], url: instance + "/tags/" + url.PathEscape(text[match[18]:match[19]])})
+		}
+	}
+
+	return richTextFromRanges(text, ranges)
+}
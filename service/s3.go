@@ -35,6 +35,12 @@ func NewS3Service() *S3Service {
 	}
 }
 
+// KeepsOriginal makes the archive store files as the origin served them, instead of the copies
+// converted for Telegram
+func (s S3Service) KeepsOriginal() bool {
+	return viper.GetBool("s3.keep_original")
+}
+
 func (s S3Service) ConsumeMedia(mediaList []*Media) {
 	for _, media := range mediaList {
 		path := fmt.Sprintf("%s/%s/%s", viper.GetString("s3.save_path"), strings.ToLower(media.Service), media.FileName)
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// How often a 429 is retried before the request is given up
+const scheduleRetryAttempts = 5
+
+// TelegramScheduler is the single way out to Telegram. Requests queue per chat and run one at a time
+// in order, spaced by the chat's rate limit and under the bot wide limit. A 429 pauses the chat for the
+// retry_after Telegram asks for and retries the request
+type TelegramScheduler struct {
+	mu     sync.Mutex
+	queues map[string]*chatQueue
+	// channels are addressed by @username and by id, both lead to one queue
+	aliases map[string]string
+	global  *rateLimiter
+	// spacing between messages to one private chat, and to one group or channel
+	privateInterval time.Duration
+	groupInterval   time.Duration
+}
+
+// scheduledJob is a request to Telegram, weight is how many messages it posts, e.g. the size of an album
+type scheduledJob struct {
+	key    string
+	weight int
+	run    func() error
+	done   chan error
+}
+
+// chatQueue holds the requests of a chat, worked by one goroutine
+type chatQueue struct {
+	cond    *sync.Cond
+	jobs    []*scheduledJob
+	limiter *rateLimiter
+}
+
+func NewTelegramScheduler() *TelegramScheduler {
+	perSecond := viper.GetInt("telegram.rate.global_per_second")
+	if perSecond <= 0 {
+		perSecond = 30
+	}
+
+	return &TelegramScheduler{
+		queues:          make(map[string]*chatQueue),
+		aliases:         make(map[string]string),
+		global:          &rateLimiter{interval: time.Second / time.Duration(perSecond)},
+		privateInterval: viper.GetDuration("telegram.rate.private_interval"),
+		groupInterval:   viper.GetDuration("telegram.rate.group_interval"),
+	}
+}
+
+// Do runs the request in the queue of chat and waits for it
+func (s *TelegramScheduler) Do(chat string, weight int, run func() error) error {
+	job := &scheduledJob{weight: weight, run: run, done: make(chan error, 1)}
+	s.enqueue(chat, job)
+	return <-job.done
+}
+
+// Post queues the request without waiting, it logs its own errors. A queued request with the same key
+// is replaced, only the latest edit of a message matters
+func (s *TelegramScheduler) Post(chat string, key string, run func() error) {
+	s.enqueue(chat, &scheduledJob{key: key, weight: 1, run: run})
+}
+
+func (s *TelegramScheduler) enqueue(chat string, job *scheduledJob) {
+	queue := s.queue(chat)
+	queue.cond.L.Lock()
+	defer queue.cond.L.Unlock()
+
+	if job.key != "" {
+		for i, queued := range queue.jobs {
+			if queued.key == job.key {
+				queue.jobs[i] = job
+				return
+			}
+		}
+	}
+	queue.jobs = append(queue.jobs, job)
+	queue.cond.Signal()
+}
+
+// queue returns the queue of chat, starting its worker on first use. Workers live as long as the
+// process, a bot talks to few chats
+func (s *TelegramScheduler) queue(chat string) *chatQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if alias, ok := s.aliases[chat]; ok {
+		chat = alias
+	}
+	if queue, ok := s.queues[chat]; ok {
+		return queue
+	}
+
+	interval := s.groupInterval
+	if id, err := strconv.ParseInt(chat, 10, 64); err == nil && id > 0 {
+		interval = s.privateInterval
+	}
+	queue := &chatQueue{
+		cond:    sync.NewCond(&sync.Mutex{}),
+		limiter: &rateLimiter{interval: interval},
+	}
+	s.queues[chat] = queue
+	go s.work(chat, queue)
+
+	return queue
+}
+
+// Alias sends requests to the chat with id to the queue of chat, e.g. the @username it was posted to
+func (s *TelegramScheduler) Alias(chatID int64, chat string) {
+	key := chatKey(chatID, "")
+	chat = strings.ToLower(chat)
+	if key == chat {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.aliases[key]; !ok {
+		s.aliases[key] = chat
+	}
+}
+
+func (s *TelegramScheduler) work(chat string, queue *chatQueue) {
+	for {
+		queue.cond.L.Lock()
+		for len(queue.jobs) == 0 {
+			queue.cond.Wait()
+		}
+		job := queue.jobs[0]
+		queue.jobs = queue.jobs[1:]
+		queue.cond.L.Unlock()
+
+		var err error
+		for attempt := 0; attempt < scheduleRetryAttempts; attempt++ {
+			queue.limiter.wait(job.weight)
+			s.global.wait(job.weight)
+
+			err = job.run()
+			retryAfter := floodWait(err)
+			if retryAfter == 0 {
+				break
+			}
+
+			log.WithFields(log.Fields{
+				"chat":        chat,
+				"retry_after": retryAfter,
+			}).Warn("Telegram rate limit hit, wait and retry")
+			queue.limiter.pause(retryAfter)
+		}
+		if retryAfter := floodWait(err); retryAfter > 0 {
+			log.WithFields(log.Fields{
+				"chat":        chat,
+				"retry_after": retryAfter,
+				"attempts":    scheduleRetryAttempts,
+			}).Error("Telegram rate limit still hit, request given up")
+		}
+
+		if job.done != nil {
+			job.done <- err
+		}
+	}
+}
+
+// floodWait is how long Telegram asks to wait after a 429, 0 for other results
+func floodWait(err error) time.Duration {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) || tgErr.Code != 429 {
+		return 0
+	}
+	if tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second
+	}
+	return time.Second
+}
+
+// chatOf is the chat a request goes to, as its chat_id parameter
+func chatOf(params tgbotapi.Params) string {
+	return strings.ToLower(params["chat_id"])
+}
+
+// chatOfConfig is chatOf for the configs of the bot api library, their params are unexported
+func chatOfConfig(config tgbotapi.Chattable) string {
+	switch c := config.(type) {
+	case tgbotapi.MessageConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.DocumentConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.EditMessageTextConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.EditMessageCaptionConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.MediaGroupConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.DeleteMessageConfig:
+		return chatKey(c.ChatID, c.ChannelUsername)
+	case tgbotapi.ChatInfoConfig:
+		return chatKey(c.ChatID, c.SuperGroupUsername)
+	case tgbotapi.GetChatMemberConfig:
+		return chatKey(c.ChatID, c.SuperGroupUsername)
+	}
+	return ""
+}
+
+func chatKey(chatID int64, channelUsername string) string {
+	if channelUsername != "" {
+		return strings.ToLower(channelUsername)
+	}
+	return strconv.FormatInt(chatID, 10)
+}
+
+// rateLimiter hands out time slots interval apart
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *rateLimiter) wait(weight int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval * time.Duration(weight))
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+func (l *rateLimiter) pause(duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(duration); l.next.Before(until) {
+		l.next = until
+	}
+}
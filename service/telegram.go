@@ -1,23 +1,36 @@
 package service
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"html"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode/utf16"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"github.com/h2non/bimg"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/wxt2005/image-capture-bot-go/db"
 )
 
-const telegramPhotoSize = 10 * 1024 * 1024 // Photo size is 10MB
-const telegramResizeRatio = 0.8
-const retryLimit = 5
+// Telegram albums hold at most 10 items
+const telegramAlbumSize = 10
+
+const (
+	OriginalModeReply = "reply"
+	OriginalModeGroup = "group"
+)
+
+// Sensitive policies: post in the clear, blur behind a spoiler, send to telegram.sensitive_channel, or drop
+const (
+	SensitivePolicyNone    = "none"
+	SensitivePolicyBlur    = "blur"
+	SensitivePolicyReroute = "reroute"
+	SensitivePolicyReject  = "reject"
+)
 
 type TelegramService struct {
 	Service        Type
@@ -25,10 +38,23 @@ type TelegramService struct {
 	token          string
 	endpointPrefix string
 	bot            *tgbotapi.BotAPI
-	likeBtnText    string
 	likeBtnAction  string
-	forceBtnText   string
 	forceBtnAction string
+	retryBtnAction string
+	// language of channel posts, replies use the language of the user
+	language string
+	// photos taller than sliceRatio times their width are cut into slices, 0 disables
+	sliceRatio   float64
+	sliceOverlap int
+	// send untouched photos as documents too, as a reply to each post or one group per content
+	originalEnabled bool
+	originalMode    string
+	// how sensitive media is posted, by channel
+	defaultSensitivePolicy string
+	sensitivePolicies      map[string]string
+	sensitiveChannel       string
+	captions               *CaptionRenderer
+	scheduler              *TelegramScheduler
 }
 
 func NewTelegramService() *TelegramService {
@@ -38,15 +64,24 @@ func NewTelegramService() *TelegramService {
 	}
 
 	return &TelegramService{
-		Service:        Telegram,
-		channelName:    viper.GetString("telegram.channel_name"),
-		token:          viper.GetString("telegram.bot_token"),
-		endpointPrefix: "https://api.telegram.org/bot" + viper.GetString("telegram.bot_token"),
-		bot:            bot,
-		likeBtnText:    "❤️ Like",
-		likeBtnAction:  "like",
-		forceBtnText:   "强制发送",
-		forceBtnAction: "force",
+		Service:                Telegram,
+		channelName:            viper.GetString("telegram.channel_name"),
+		token:                  viper.GetString("telegram.bot_token"),
+		endpointPrefix:         "https://api.telegram.org/bot" + viper.GetString("telegram.bot_token"),
+		bot:                    bot,
+		likeBtnAction:          "like",
+		forceBtnAction:         "force",
+		retryBtnAction:         "retry",
+		language:               defaultLanguage(),
+		sliceRatio:             viper.GetFloat64("telegram.slice_ratio"),
+		sliceOverlap:           viper.GetInt("telegram.slice_overlap"),
+		originalEnabled:        viper.GetBool("telegram.original_enabled"),
+		originalMode:           viper.GetString("telegram.original_mode"),
+		defaultSensitivePolicy: viper.GetString("telegram.sensitive_policy"),
+		sensitivePolicies:      viper.GetStringMapString("telegram.sensitive_policies"),
+		sensitiveChannel:       viper.GetString("telegram.sensitive_channel"),
+		captions:               NewCaptionRenderer(),
+		scheduler:              NewTelegramScheduler(),
 	}
 }
 
@@ -105,57 +140,330 @@ func (s TelegramService) ExtractURL(msg *tgbotapi.Message) []string {
 	return urls
 }
 
-func (s TelegramService) UpdateLikeButton(chatID int64, messageID int, count int) error {
-	keyboardButton := tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s (%d)", s.likeBtnText, count), s.likeBtnAction)
+// IsLinkOnly reports if the message is text holding nothing but links, and hashtags such as #original
+func (s TelegramService) IsLinkOnly(msg *tgbotapi.Message) bool {
+	if msg.Text == "" || len(msg.Entities) == 0 {
+		return false
+	}
+
+	utf16Runes := utf16.Encode([]rune(msg.Text))
+	for _, entity := range msg.Entities {
+		if entity.Type != "url" && entity.Type != "text_link" && entity.Type != "hashtag" {
+			continue
+		}
+		for i := entity.Offset; i < entity.Offset+entity.Length && i < len(utf16Runes); i++ {
+			utf16Runes[i] = ' '
+		}
+	}
+
+	return strings.TrimSpace(string(utf16.Decode(utf16Runes))) == "" && len(s.ExtractURL(msg)) > 0
+}
+
+// HasHashtag reports if the text or caption of the message carries #tag
+func (s TelegramService) HasHashtag(msg *tgbotapi.Message, tag string) bool {
+	return hasHashtag(msg.Text, msg.Entities, tag) || hasHashtag(msg.Caption, msg.CaptionEntities, tag)
+}
+
+func hasHashtag(text string, entities []tgbotapi.MessageEntity, tag string) bool {
+	utf16Runes := utf16.Encode([]rune(text))
+	for _, entity := range entities {
+		if entity.Type != "hashtag" || entity.Offset+entity.Length > len(utf16Runes) {
+			continue
+		}
+		hashtag := string(utf16.Decode(utf16Runes[entity.Offset : entity.Offset+entity.Length]))
+		if strings.EqualFold(hashtag, "#"+tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UpdateLikeButton shows the like count of the post primary on one of its messages. The edit is queued,
+// a burst of likes ends up as one edit with the latest count
+func (s TelegramService) UpdateLikeButton(chatID int64, messageID int, primary int, count int) {
+	config := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, s.likeKeyboard(messageID, primary, count))
+
+	s.scheduler.Post(chatKey(chatID, ""), fmt.Sprintf("like_%d", messageID), func() error {
+		_, err := s.bot.Send(config)
+
+		if err != nil && floodWait(err) == 0 {
+			jsonByte, _ := json.Marshal(config)
+			log.WithFields(log.Fields{
+				"config": string(jsonByte),
+				"error":  err,
+			}).Error("Update like button failed")
+		}
+
+		return err
+	})
+}
+
+// SendDuplicateMessage replies with the duplicate url, and the earlier post if it was recorded
+func (s TelegramService) SendDuplicateMessage(url string, record *db.URLRecord, likeCount int, chatID int64, messageID int, lang string) error {
+	keyboardButton := tgbotapi.NewInlineKeyboardButtonData(Translate(lang, "button.force"), s.forceBtnAction)
 	keyboardRow := tgbotapi.NewInlineKeyboardRow(keyboardButton)
 	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(keyboardRow)
-	config := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboardMarkup)
-	_, err := s.bot.Send(config)
+	text := Translate(lang, "duplicate.url", fmt.Sprintf("<a href=\"%s\">%s</a>", url, url))
+	if record != nil {
+		if !record.FirstSeen.IsZero() {
+			text += "\n" + Translate(lang, "duplicate.first_seen", record.FirstSeen.Format("2006-01-02 15:04"))
+			if record.Submitter != "" {
+				text += fmt.Sprintf(" (%s)", html.EscapeString(record.Submitter))
+			}
+		}
+		if len(record.Posts) > 0 {
+			post := record.Posts[0]
+			text += "\n" + Translate(lang, "duplicate.post", fmt.Sprintf("<a href=\"%s\">%s</a>", post.Link(), post.Date.Format("2006-01-02 15:04")), likeCount)
+		}
+	}
+	config := tgbotapi.NewMessage(chatID, text)
+	config.DisableWebPagePreview = true
+	config.DisableNotification = true
+	config.ParseMode = tgbotapi.ModeHTML
+	config.ReplyToMessageID = messageID
+	config.ReplyMarkup = keyboardMarkup
+
+	_, err := s.send(config)
 
 	if err != nil {
 		jsonByte, _ := json.Marshal(config)
 		log.WithFields(log.Fields{
 			"config": string(jsonByte),
 			"error":  err,
-		}).Error("Update like button failed")
+		}).Error("Send duplicate message failed")
 	}
 
 	return err
 }
 
-func (s TelegramService) SendDuplicateMessage(url string, chatID int64, messageID int) error {
-	keyboardButton := tgbotapi.NewInlineKeyboardButtonData(s.forceBtnText, s.forceBtnAction)
-	keyboardRow := tgbotapi.NewInlineKeyboardRow(keyboardButton)
-	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(keyboardRow)
-	config := tgbotapi.NewMessage(chatID, fmt.Sprintf("图片地址重复: <a href=\"%s\">%s</a>", url, url))
+type URLState string
+
+const (
+	URLPending     URLState = "pending"
+	URLPosted      URLState = "posted"
+	URLUnsupported URLState = "unsupported"
+	URLFailed      URLState = "failed"
+	URLDuplicate   URLState = "duplicate"
+	URLQueued      URLState = "queued"
+	URLReview      URLState = "review"
+)
+
+// URLStatus is a line of the status reply to a submission
+type URLStatus struct {
+	URL    string
+	State  URLState
+	Reason string
+
+	// line restored from a sent status reply, rendered as it was
+	line string
+}
+
+const statusReasonLimit = 80
+
+var statusReasonURLRegexp = regexp.MustCompile(`(?i)\w+://\S+`)
+
+// SendStatusMessage replies to a submission with the state of each url, returns the message id for later updates
+func (s TelegramService) SendStatusMessage(statuses []*URLStatus, chatID int64, messageID int, lang string) (int, error) {
+	config := tgbotapi.NewMessage(chatID, renderStatuses(statuses, lang))
 	config.DisableWebPagePreview = true
 	config.DisableNotification = true
 	config.ParseMode = tgbotapi.ModeHTML
 	config.ReplyToMessageID = messageID
-	config.ReplyMarkup = keyboardMarkup
+	if keyboardMarkup := s.retryKeyboard(statuses, lang); keyboardMarkup != nil {
+		config.ReplyMarkup = keyboardMarkup
+	}
 
-	_, err := s.bot.Send(config)
+	message, err := s.send(config)
 
 	if err != nil {
 		jsonByte, _ := json.Marshal(config)
 		log.WithFields(log.Fields{
 			"config": string(jsonByte),
 			"error":  err,
-		}).Error("Send duplicate message failed")
+		}).Error("Send status message failed")
+		return 0, err
+	}
+
+	return message.MessageID, nil
+}
+
+// UpdateStatusMessage queues an edit of the status reply, rendered as the statuses are now. Only the
+// latest of the edits waiting in the queue is sent
+func (s TelegramService) UpdateStatusMessage(statuses []*URLStatus, chatID int64, messageID int, lang string) {
+	config := tgbotapi.NewEditMessageText(chatID, messageID, renderStatuses(statuses, lang))
+	config.DisableWebPagePreview = true
+	config.ParseMode = tgbotapi.ModeHTML
+	config.ReplyMarkup = s.retryKeyboard(statuses, lang)
+
+	s.scheduler.Post(chatKey(chatID, ""), fmt.Sprintf("status_%d", messageID), func() error {
+		_, err := s.bot.Send(config)
+
+		// editing to the same content is rejected, nothing changed in that case
+		if err != nil && strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		if err != nil && floodWait(err) == 0 {
+			jsonByte, _ := json.Marshal(config)
+			log.WithFields(log.Fields{
+				"config": string(jsonByte),
+				"error":  err,
+			}).Error("Update status message failed")
+		}
+
+		return err
+	})
+}
+
+// DropRetryButton removes the retry button of the url at index once it was pressed
+func (s TelegramService) DropRetryButton(msg *tgbotapi.Message, index int) error {
+	if msg.ReplyMarkup == nil {
+		return nil
+	}
+
+	data := fmt.Sprintf("%s_%d", s.retryBtnAction, index)
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, row := range msg.ReplyMarkup.InlineKeyboard {
+		if len(row) > 0 && row[0].CallbackData != nil && *row[0].CallbackData == data {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	config := tgbotapi.NewEditMessageReplyMarkup(msg.Chat.ID, msg.MessageID, tgbotapi.InlineKeyboardMarkup{InlineKeyboard: rows})
+	if rows == nil {
+		config.ReplyMarkup = nil
+	}
+	_, err := s.send(config)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Drop retry button failed")
 	}
 
 	return err
 }
 
-func (s TelegramService) SendAuthMessage(chatID int64, messageID int, isSuccess bool) error {
+// RestoreStatuses reads the statuses back from a status reply so a retry can edit it. Lines are kept as
+// they were rendered, urls that still have a retry button stay failed
+func (s TelegramService) RestoreStatuses(msg *tgbotapi.Message) []*URLStatus {
+	failed := make(map[string]bool)
+	if msg.ReplyMarkup != nil {
+		for _, row := range msg.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				if button.CallbackData != nil {
+					failed[*button.CallbackData] = true
+				}
+			}
+		}
+	}
+
+	lines := splitStatusLines(msg.Text)
+	var statuses []*URLStatus
+	for index, url := range s.ExtractURL(msg) {
+		status := &URLStatus{URL: url}
+		if index < len(lines) {
+			status.line = lines[index]
+		}
+		if failed[fmt.Sprintf("%s_%d", s.retryBtnAction, index)] {
+			status.State = URLFailed
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+var statusLineRegexp = regexp.MustCompile(`(?m)^(\d+)\. `)
+
+// splitStatusLines cuts the text of a status reply at its numbered lines, a reason may span several
+func splitStatusLines(text string) []string {
+	var lines []string
+	var start int
+	for _, match := range statusLineRegexp.FindAllStringSubmatchIndex(text, -1) {
+		if text[match[2]:match[3]] != strconv.Itoa(len(lines)+1) {
+			continue
+		}
+		if len(lines) > 0 {
+			lines[len(lines)-1] = strings.TrimRight(text[start:match[0]], "\n")
+		}
+		lines = append(lines, "")
+		start = match[1]
+	}
+	if len(lines) > 0 {
+		lines[len(lines)-1] = text[start:]
+	}
+
+	return lines
+}
+
+// retryKeyboard has a retry button for every failed url, the callback data carries the url index
+func (s TelegramService) retryKeyboard(statuses []*URLStatus, lang string) *tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for index, status := range statuses {
+		if status.State != URLFailed {
+			continue
+		}
+		keyboardButton := tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s #%d", Translate(lang, "button.retry"), index+1), fmt.Sprintf("%s_%d", s.retryBtnAction, index))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(keyboardButton))
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &keyboardMarkup
+}
+
+// renderStatuses lists every url with its state, one link per line so a retry can find its url by index
+func renderStatuses(statuses []*URLStatus, lang string) string {
+	var lines []string
+	for index, status := range statuses {
+		link := fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(status.URL), html.EscapeString(status.URL))
+		if status.line != "" {
+			line := strings.Replace(html.EscapeString(status.line), html.EscapeString(status.URL), link, 1)
+			lines = append(lines, fmt.Sprintf("%d. %s", index+1, line))
+			continue
+		}
+		var line string
+		switch status.State {
+		case URLPending:
+			line = Translate(lang, "status.pending", link)
+		case URLPosted:
+			line = Translate(lang, "status.posted", link)
+		case URLUnsupported:
+			line = Translate(lang, "status.unsupported", link)
+		case URLDuplicate:
+			line = Translate(lang, "status.duplicate", link)
+		case URLQueued:
+			line = Translate(lang, "status.queued", link)
+		case URLReview:
+			line = Translate(lang, "status.review", link)
+		case URLFailed:
+			// urls in the reason would be picked up as entities and shift the retry index
+			reason := []rune(statusReasonURLRegexp.ReplaceAllString(status.Reason, "…"))
+			if len(reason) > statusReasonLimit {
+				reason = append(reason[:statusReasonLimit], '…')
+			}
+			line = Translate(lang, "status.failed", link, html.EscapeString(string(reason)))
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s", index+1, line))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (s TelegramService) SendAuthMessage(chatID int64, messageID int, isSuccess bool, lang string) error {
 	var config tgbotapi.MessageConfig
 	if isSuccess {
-		config = tgbotapi.NewMessage(chatID, "授权成功")
+		config = tgbotapi.NewMessage(chatID, Translate(lang, "auth.success"))
 	} else {
-		config = tgbotapi.NewMessage(chatID, "授权失败")
+		config = tgbotapi.NewMessage(chatID, Translate(lang, "auth.failed"))
 	}
 
-	_, err := s.bot.Send(config)
+	_, err := s.send(config)
 
 	if err != nil {
 		jsonByte, _ := json.Marshal(config)
@@ -168,10 +476,10 @@ func (s TelegramService) SendAuthMessage(chatID int64, messageID int, isSuccess
 	return err
 }
 
-func (s TelegramService) SendWelcomeMessage(chatID int64, messageID int) error {
-	config := tgbotapi.NewMessage(chatID, "meow")
+func (s TelegramService) SendWelcomeMessage(chatID int64, messageID int, lang string) error {
+	config := tgbotapi.NewMessage(chatID, Translate(lang, "welcome"))
 
-	_, err := s.bot.Send(config)
+	_, err := s.send(config)
 
 	if err != nil {
 		jsonByte, _ := json.Marshal(config)
@@ -184,10 +492,10 @@ func (s TelegramService) SendWelcomeMessage(chatID int64, messageID int) error {
 	return err
 }
 
-func (s TelegramService) SendNoPremissionMessage(chatID int64, messageID int) error {
-	config := tgbotapi.NewMessage(chatID, "您没有执行此操作的权限，请联系管理员")
+func (s TelegramService) SendNoPremissionMessage(chatID int64, messageID int, lang string) error {
+	config := tgbotapi.NewMessage(chatID, Translate(lang, "no_permission"))
 
-	_, err := s.bot.Send(config)
+	_, err := s.send(config)
 
 	if err != nil {
 		jsonByte, _ := json.Marshal(config)
@@ -200,15 +508,15 @@ func (s TelegramService) SendNoPremissionMessage(chatID int64, messageID int) er
 	return err
 }
 
-func (s TelegramService) SendRevokeMessage(chatID int64, messageID int, isSuccess bool) error {
+func (s TelegramService) SendRevokeMessage(chatID int64, messageID int, isSuccess bool, lang string) error {
 	var config tgbotapi.MessageConfig
 	if isSuccess {
-		config = tgbotapi.NewMessage(chatID, "解除授权成功")
+		config = tgbotapi.NewMessage(chatID, Translate(lang, "revoke.success"))
 	} else {
-		config = tgbotapi.NewMessage(chatID, "解除授权失败")
+		config = tgbotapi.NewMessage(chatID, Translate(lang, "revoke.failed"))
 	}
 
-	_, err := s.bot.Send(config)
+	_, err := s.send(config)
 
 	if err != nil {
 		jsonByte, _ := json.Marshal(config)
@@ -221,230 +529,793 @@ func (s TelegramService) SendRevokeMessage(chatID int64, messageID int, isSucces
 	return err
 }
 
+// SendLanguageMessage answers /lang, arg is what the user asked for, empty to show the current language
+func (s TelegramService) SendLanguageMessage(chatID int64, messageID int, lang string, arg string, changed bool) error {
+	var available []string
+	for _, code := range Languages {
+		available = append(available, fmt.Sprintf("%s (%s)", code, Translate(code, "language.name")))
+	}
+
+	var text string
+	switch {
+	case changed:
+		text = Translate(lang, "lang.changed")
+	case arg != "":
+		text = Translate(lang, "lang.unsupported", arg, strings.Join(available, ", "))
+	default:
+		text = Translate(lang, "lang.current", Translate(lang, "language.name"), strings.Join(available, ", "))
+	}
+	config := tgbotapi.NewMessage(chatID, text)
+	config.ReplyToMessageID = messageID
+
+	_, err := s.send(config)
+
+	if err != nil {
+		jsonByte, _ := json.Marshal(config)
+		log.WithFields(log.Fields{
+			"config": string(jsonByte),
+			"error":  err,
+		}).Error("Send language message failed")
+	}
+
+	return err
+}
+
+// SendText replies with plain text, for command results
+func (s TelegramService) SendText(chatID int64, messageID int, text string) error {
+	config := tgbotapi.NewMessage(chatID, text)
+	config.ReplyToMessageID = messageID
+	config.DisableWebPagePreview = true
+
+	_, err := s.send(config)
+
+	if err != nil {
+		jsonByte, _ := json.Marshal(config)
+		log.WithFields(log.Fields{
+			"config": string(jsonByte),
+			"error":  err,
+		}).Error("Send text message failed")
+	}
+
+	return err
+}
+
 func (s TelegramService) ConsumeMedia(mediaList []*Media) {
+	s.PostMedia(mediaList)
+}
+
+// ErrMediaRejected is reported for sensitive media the channel policy turns away
+var ErrMediaRejected = errors.New("rejected by channel policy")
+
+// PostMedia posts media to their channel and reports how each content went
+func (s TelegramService) PostMedia(mediaList []*Media) ConsumeResult {
+	result := make(ConsumeResult)
+	var originals []*originalPost
 	for _, media := range mediaList {
-		var err error
-		if media.File != nil {
-			err = s.sendByStream(media, false, 0)
-		} else {
-			err = s.sendByURL(media)
+		if _, ok := result[media.Identity]; !ok {
+			result[media.Identity] = nil
 		}
+
+		target, ok := s.targetFor(media)
+		if !ok {
+			log.WithFields(log.Fields{
+				"url":    media.URL,
+				"source": media.Source,
+			}).Info("Sensitive media rejected by channel policy")
+			result.fail(media.Identity, ErrMediaRejected)
+			continue
+		}
+		target.caption, target.overflow = s.captions.Render(media, target.chat)
+
+		message, err := s.sendMedia(media, target)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
 			}).Error("Send telegram media failed")
+			result.fail(media.Identity, err)
+			continue
+		}
+		s.recordPost(media, &message)
+		if message.Chat != nil {
+			s.scheduler.Alias(message.Chat.ID, target.chat)
+		}
+		s.sendOverflow(media, &message, target)
+
+		// documents can't be hidden behind a spoiler, their preview would give the photo away
+		if s.wantsOriginal(media) && !target.spoiler && message.Chat != nil {
+			post := &originalPost{media: media, message: message}
+			if s.originalMode == OriginalModeGroup {
+				originals = append(originals, post)
+			} else {
+				s.sendOriginal(post)
+			}
 		}
 	}
+
+	s.sendOriginalGroups(originals)
+
+	return result
 }
 
-func (s TelegramService) sendByURL(media *Media) error {
-	keyboardButton := tgbotapi.NewInlineKeyboardButtonData(s.likeBtnText, s.likeBtnAction)
-	keyboardRow := tgbotapi.NewInlineKeyboardRow(keyboardButton)
-	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(keyboardRow)
-	var config tgbotapi.Chattable
+// sendMedia sends a media by url, or by uploading it when Telegram can't take the url
+func (s TelegramService) sendMedia(media *Media, target sendTarget) (tgbotapi.Message, error) {
+	if media.File != nil {
+		return s.sendByStream(media, target)
+	}
+	if target.urlOnly {
+		return s.sendByURL(media, target)
+	}
+	if s.needsSlicing(media) && target.keyboard == nil {
+		// Telegram would squash it by url, slicing needs the file
+		return s.sendByDownload(media, target)
+	}
+
+	message, err := s.sendByURL(media, target)
+	if err != nil && len(media.TGFileID) == 0 && shouldUploadInstead(err) {
+		message, err = s.sendByDownload(media, target)
+	}
+	return message, err
+}
+
+// sendTarget is where and how a media is posted
+type sendTarget struct {
+	chat    string
+	spoiler bool
+	caption string
+	// overflow is the description that didn't fit the caption, continued in replies
+	overflow RichText
+	// embeds reply to replyTo in a group, without like button
+	replyTo int
+	embed   bool
+	// urlOnly leaves fetching to Telegram, the bot never downloads the media
+	urlOnly bool
+	// keyboard replaces the like button, such media is sent whole since albums can't have one
+	keyboard *tgbotapi.InlineKeyboardMarkup
+}
+
+// targetFor applies the sensitive policy of the channel, false if the media must not be posted
+func (s TelegramService) targetFor(media *Media) (sendTarget, bool) {
+	target := sendTarget{chat: s.channelName}
+	if media.Channel != "" {
+		target.chat = media.Channel
+	}
+	if !media.Sensitive {
+		return target, true
+	}
+
+	switch s.sensitivePolicy(target.chat) {
+	case SensitivePolicyNone:
+	case SensitivePolicyReject:
+		return target, false
+	case SensitivePolicyReroute:
+		if s.sensitiveChannel != "" {
+			target.chat = s.sensitiveChannel
+			// the other channel may still want it blurred
+			target.spoiler = s.sensitivePolicy(s.sensitiveChannel) == SensitivePolicyBlur
+			break
+		}
+		target.spoiler = true
+	default:
+		target.spoiler = true
+	}
+
+	return target, true
+}
+
+// sendOverflow continues a cut description in replies to the post
+func (s TelegramService) sendOverflow(media *Media, post *tgbotapi.Message, target sendTarget) {
+	if len(target.overflow) == 0 || post.Chat == nil {
+		return
+	}
+
+	var messageIDs []int
+	replyTo := post.MessageID
+	for _, text := range target.overflow.Split(telegramMessageLimit) {
+		html := text.HTML()
+		// the caption hides the description behind its content warning, so does the rest of it
+		if media.ContentWarning != "" {
+			html = "<tg-spoiler>" + html + "</tg-spoiler>"
+		}
+		config := tgbotapi.NewMessage(post.Chat.ID, html)
+		config.ParseMode = tgbotapi.ModeHTML
+		config.DisableWebPagePreview = true
+		config.DisableNotification = true
+		config.ReplyToMessageID = replyTo
+
+		message, err := s.send(config)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   media.URL,
+				"error": err,
+			}).Error("Send caption overflow failed")
+			break
+		}
+		messageIDs = append(messageIDs, message.MessageID)
+		replyTo = message.MessageID
+	}
 
+	if len(messageIDs) > 0 {
+		s.linkPost(post.Chat.ID, post.MessageID, media.Identity, false, messageIDs...)
+	}
+}
+
+func (s TelegramService) sensitivePolicy(chat string) string {
+	// viper lowercases map keys
+	if policy, ok := s.sensitivePolicies[strings.ToLower(chat)]; ok {
+		return policy
+	}
+	return s.defaultSensitivePolicy
+}
+
+// originalPost is a sent photo waiting for its original file
+type originalPost struct {
+	media   *Media
+	message tgbotapi.Message
+}
+
+func (s TelegramService) wantsOriginal(media *Media) bool {
+	return media.Type == "photo" && (s.originalEnabled || media.SendOriginal)
+}
+
+// originalFile returns the untouched file, downloading it if the provider only gave an url
+func (s TelegramService) originalFile(media *Media) ([]byte, error) {
+	if media.Original != nil {
+		media = media.Original
+	}
+	if media.File != nil {
+		return *media.File, nil
+	}
+
+	return downloadMedia(media)
+}
+
+// sendOriginal replies to a post with its original file as a document, sharing the post's like button
+func (s TelegramService) sendOriginal(post *originalPost) {
+	file, err := s.originalFile(post.media)
+	if err == nil && len(file) > telegramUploadSize {
+		err = fmt.Errorf("original too large: %d bytes", len(file))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   post.media.URL,
+			"error": err,
+		}).Error("Get original file failed")
+		return
+	}
+
+	chatID := post.message.Chat.ID
+	primary := post.message.MessageID
+	likeButton := tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.like"), s.likeAction(primary, true))
+	config := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: post.media.FileName, Bytes: file})
+	config.ReplyToMessageID = primary
+	config.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(likeButton))
+
+	message, err := s.send(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   post.media.URL,
+			"error": err,
+		}).Error("Send original document failed")
+		return
+	}
+
+	s.linkPost(chatID, primary, post.media.Identity, true, message.MessageID)
+}
+
+// sendOriginalGroups sends the originals of each content as document groups, replying to its first post.
+// Document groups can't have a keyboard, likes stay on the post
+func (s TelegramService) sendOriginalGroups(posts []*originalPost) {
+	var order []string
+	groups := make(map[string][]*originalPost)
+	for _, post := range posts {
+		// media without identity came from a forwarded message, keep them apart
+		key := post.media.Identity
+		if key == "" {
+			key = fmt.Sprintf("msg_%d", post.message.MessageID)
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], post)
+	}
+
+	for _, key := range order {
+		group := groups[key]
+		chatID := group[0].message.Chat.ID
+		primary := group[0].message.MessageID
+
+		var items []interface{}
+		var messageIDs []int
+		for i, post := range group {
+			file, err := s.originalFile(post.media)
+			if err == nil && len(file) > telegramUploadSize {
+				err = fmt.Errorf("original too large: %d bytes", len(file))
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"url":   post.media.URL,
+					"error": err,
+				}).Error("Get original file failed")
+			} else {
+				items = append(items, tgbotapi.NewInputMediaDocument(tgbotapi.FileBytes{Name: post.media.FileName, Bytes: file}))
+			}
+
+			if len(items) == telegramAlbumSize || (i == len(group)-1 && len(items) > 0) {
+				config := tgbotapi.NewMediaGroup(chatID, items)
+				config.ReplyToMessageID = primary
+				messages, err := s.sendMediaGroup(config)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"identity": group[0].media.Identity,
+						"error":    err,
+					}).Error("Send original documents failed")
+				}
+				for _, message := range messages {
+					messageIDs = append(messageIDs, message.MessageID)
+				}
+				items = nil
+			}
+		}
+
+		if len(messageIDs) > 0 {
+			s.linkPost(chatID, primary, group[0].media.Identity, false, messageIDs...)
+		}
+	}
+}
+
+func (s TelegramService) linkPost(chatID int64, primary int, identity string, withButton bool, messageIDs ...int) {
+	if err := db.LinkPostMessages(chatID, primary, identity, withButton, messageIDs...); err != nil {
+		log.WithFields(log.Fields{
+			"identity": identity,
+			"error":    err,
+		}).Error("Link post messages failed")
+	}
+}
+
+// recordPost saves the channel message against the content identity, so duplicates can link to it
+func (s TelegramService) recordPost(media *Media, message *tgbotapi.Message) {
+	if media.Identity == "" || message.Chat == nil {
+		return
+	}
+
+	err := db.AddURLPost(media.Identity, PostRefOf(message))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"identity": media.Identity,
+			"error":    err,
+		}).Error("Record telegram post failed")
+	}
+	// a post alone has a link too, it leads from the message to the identity
+	s.linkPost(message.Chat.ID, message.MessageID, media.Identity, true)
+}
+
+func (s TelegramService) sendByURL(media *Media, target sendTarget) (tgbotapi.Message, error) {
 	url := media.URL
 	if len(media.TGFileID) != 0 {
 		url = media.TGFileID
 	}
 
 	switch media.Type {
-	case "photo":
-		config = tgbotapi.PhotoConfig{
-			Caption:   generateCaption(media),
-			ParseMode: "MarkdownV2",
-			BaseFile: tgbotapi.BaseFile{
-				BaseChat: tgbotapi.BaseChat{
-					ChannelUsername: s.channelName,
-					ReplyMarkup:     keyboardMarkup,
-				},
-				File: tgbotapi.FileURL(url),
-			},
-		}
-	case "video":
-		config = tgbotapi.VideoConfig{
-			Caption:   generateCaption(media),
-			ParseMode: "MarkdownV2",
-			BaseFile: tgbotapi.BaseFile{
-				BaseChat: tgbotapi.BaseChat{
-					ChannelUsername: s.channelName,
-					ReplyMarkup:     keyboardMarkup,
-				},
-				File: tgbotapi.FileURL(url),
-			},
-		}
-	case "animation":
-		config = tgbotapi.AnimationConfig{
-			Caption:   generateCaption(media),
-			ParseMode: "MarkdownV2",
-			BaseFile: tgbotapi.BaseFile{
-				BaseChat: tgbotapi.BaseChat{
-					ChannelUsername: s.channelName,
-					ReplyMarkup:     keyboardMarkup,
-				},
-				File: tgbotapi.FileURL(url),
-			},
-		}
+	case "photo", "video", "animation":
 	default:
-		return nil
+		return tgbotapi.Message{}, nil
 	}
 
-	_, err := s.bot.Send(config)
+	message, err := s.sendMediaFile(media, media.Type, tgbotapi.FileURL(url), target)
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"url":   media.URL,
 			"error": err,
-		}).Error("Send image by url failed")
+		}).Error("Send media by url failed")
 	}
 
-	return err
+	return message, err
 }
 
-func (s TelegramService) sendByStream(media *Media, forceRisze bool, retryCount int) error {
-	likeButton := tgbotapi.NewInlineKeyboardButtonData(s.likeBtnText, "like")
-	keyboardRow := tgbotapi.NewInlineKeyboardRow(likeButton)
-	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(keyboardRow)
-	var config tgbotapi.Chattable
+// sendByDownload downloads the file ourselves and uploads it, for urls Telegram failed to fetch
+func (s TelegramService) sendByDownload(media *Media, target sendTarget) (tgbotapi.Message, error) {
+	log.WithField("url", media.URL).Info("Send by url failed, fall back to upload")
+
+	file, err := downloadMedia(media)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   media.URL,
+			"error": err,
+		}).Error("Download media failed")
+		return tgbotapi.Message{}, err
+	}
+
+	// other consumers share the media, keep ours to a copy
+	streamMedia := *media
+	streamMedia.File = &file
+
+	// the file was not there when the media went through the transformers, run them again on it
+	transformed := &streamMedia
+	for _, transformer := range GetServiceManager().Transformers {
+		result, err := transformer.Transform(transformed)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   media.URL,
+				"error": err,
+			}).Error("Transform downloaded media failed")
+			continue
+		}
+		transformed = result
+	}
+
+	return s.sendByStream(transformed, target)
+}
+
+// Telegram errors meaning it could not fetch or process the remote file, uploading it ourselves may work
+var uploadRecoverableErrors = []string{
+	"failed to get http url content",
+	"wrong file identifier/http url specified",
+	"wrong type of the web page content",
+	"webpage_curl_failed",
+	"webpage_media_empty",
+	"request entity too large",
+	"file is too big",
+	"photo_invalid_dimensions",
+	"image_process_failed",
+	"photo_save_file_invalid",
+}
+
+// shouldUploadInstead classifies a send by url error, true if a streamed upload is worth a try
+func shouldUploadInstead(err error) bool {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		// network errors talking to Telegram, uploading won't help
+		return false
+	}
+
+	message := strings.ToLower(tgErr.Message)
+	for _, pattern := range uploadRecoverableErrors {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s TelegramService) sendByStream(media *Media, target sendTarget) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	var err error
 
 	switch media.Type {
 	case "photo":
-		imageFile := *media.File
-		for len(imageFile) >= telegramPhotoSize {
-			log.Info("Photo too large, start compress")
-			imageFile = *zoomeLargeImage(&imageFile, telegramResizeRatio)
-			log.WithField("Resized Size", len(imageFile)).Info("Resized")
-		}
-		if forceRisze && retryCount < retryLimit {
-			imageFile = *zoomeLargeImage(&imageFile, telegramResizeRatio)
-			log.WithField("Resized Size", len(imageFile)).Info("Force Resized")
-		}
-		config = tgbotapi.PhotoConfig{
-			Caption:   generateCaption(media),
-			ParseMode: "MarkdownV2",
-			BaseFile: tgbotapi.BaseFile{
-				BaseChat: tgbotapi.BaseChat{
-					ChannelUsername: s.channelName,
-					ReplyMarkup:     keyboardMarkup,
-				},
-				File: tgbotapi.FileReader{
-					Name:   media.FileName,
-					Reader: bytes.NewReader(imageFile),
-				},
-			},
-		}
-	case "video":
-		config = tgbotapi.VideoConfig{
-			Caption:   generateCaption(media),
-			ParseMode: "MarkdownV2",
-			BaseFile: tgbotapi.BaseFile{
-				BaseChat: tgbotapi.BaseChat{
-					ChannelUsername: s.channelName,
-					ReplyMarkup:     keyboardMarkup,
-				},
-				File: tgbotapi.FileReader{
-					Name:   media.FileName,
-					Reader: bytes.NewReader(*media.File),
-				},
-			},
-		}
-	case "animation":
-		config = tgbotapi.AnimationConfig{
-			Caption:   generateCaption(media),
-			ParseMode: "MarkdownV2",
-			BaseFile: tgbotapi.BaseFile{
-				BaseChat: tgbotapi.BaseChat{
-					ChannelUsername: s.channelName,
-					ReplyMarkup:     keyboardMarkup,
-				},
-				File: tgbotapi.FileReader{
-					Name:   media.FileName,
-					Reader: bytes.NewReader(*media.File),
-				},
-			},
+		var slices [][]byte
+		var sliceErr error
+		if target.keyboard == nil {
+			slices, sliceErr = sliceTallImage(*media.File, s.sliceRatio, s.sliceOverlap)
+		}
+		if sliceErr != nil {
+			log.WithFields(log.Fields{
+				"url":   media.URL,
+				"error": sliceErr,
+			}).Warn("Slice photo failed, send as a whole")
+		} else if slices != nil {
+			return s.sendSlices(media, slices, target)
 		}
+
+		// fit a copy, the original stays for archive consumers
+		imageFile, fitErr := fitTelegramPhoto(*media.File)
+		if errors.Is(fitErr, errPhotoRatio) && target.spoiler {
+			// a document has no spoiler, pad it into a photo instead
+			imageFile, fitErr = padTelegramPhoto(*media.File)
+		} else if errors.Is(fitErr, errPhotoRatio) {
+			log.WithField("url", media.URL).Info("Photo ratio out of limit, send as document")
+			message, err = s.sendMediaFile(media, "document", tgbotapi.FileBytes{Name: media.FileName, Bytes: *media.File}, target)
+			break
+		}
+		if fitErr != nil {
+			log.WithFields(log.Fields{
+				"url":   media.URL,
+				"error": fitErr,
+			}).Error("Fit photo failed")
+			return tgbotapi.Message{}, fitErr
+		}
+		message, err = s.sendMediaFile(media, "photo", tgbotapi.FileBytes{Name: media.FileName, Bytes: imageFile}, target)
+	case "video", "animation":
+		message, err = s.sendMediaFile(media, media.Type, tgbotapi.FileBytes{Name: media.FileName, Bytes: *media.File}, target)
 	default:
-		return nil
+		return tgbotapi.Message{}, nil
 	}
 
-	_, err := s.bot.Send(config)
-
 	if err != nil {
 		log.WithFields(log.Fields{
 			"url":   media.URL,
 			"error": err,
-		}).Error("Send image by stream failed")
-
-		// if message includes PHOTO_INVALID_DIMENSIONS, try to send again
-		if strings.Contains(err.Error(), "PHOTO_INVALID_DIMENSIONS") {
-			log.Info("Try to send again")
-			s.sendByStream(media, true, retryCount+1)
-		}
+		}).Error("Send media by stream failed")
 	}
 
-	return err
+	return message, err
+}
+
+// likeKeyboard is the like button of a message of the post primary, with the count once there are likes
+func (s TelegramService) likeKeyboard(messageID int, primary int, count int) tgbotapi.InlineKeyboardMarkup {
+	text := Translate(s.language, "button.like")
+	if count > 0 {
+		text = fmt.Sprintf("%s (%d)", text, count)
+	}
+	keyboardButton := tgbotapi.NewInlineKeyboardButtonData(text, s.likeAction(primary, messageID != primary))
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(keyboardButton))
 }
 
-func generateCaption(media *Media) string {
-	result := ""
-	if media.Title != "" {
-		result += ("*" + escape(media.Title) + "*\n")
+// likeAction is the like callback data of a post, messages linked to it point to the primary
+func (s TelegramService) likeAction(primary int, linked bool) string {
+	if !linked {
+		return s.likeBtnAction
 	}
-	if media.Description != "" {
-		result += ("" + escape(media.Description) + "\n")
+	return fmt.Sprintf("%s_%d", s.likeBtnAction, primary)
+}
+
+// needsSlicing tells from the dimensions reported by the provider if a photo sent by url should be sliced
+func (s TelegramService) needsSlicing(media *Media) bool {
+	if media.Type != "photo" || len(media.TGFileID) != 0 || s.sliceRatio <= 0 || media.Width == 0 {
+		return false
 	}
-	if media.Author != "" {
-		result += "作者: "
-		authorText := escape(media.Author)
-		if media.AuthorURL != "" {
-			result += ("[" + authorText + "](" + media.AuthorURL + ")\n")
-		} else {
-			result += (authorText + "\n")
+
+	return float64(media.Height)/float64(media.Width) > s.sliceRatio
+}
+
+// sendSlices sends slices of a tall photo as ordered albums, albums can't have a keyboard so the like
+// button goes in a reply under the first one. The reply is returned, likes are counted on it
+func (s TelegramService) sendSlices(media *Media, slices [][]byte, target sendTarget) (tgbotapi.Message, error) {
+	var first *tgbotapi.Message
+	var albumIDs []int
+	var album []db.PostRef
+
+	for start := 0; start < len(slices); start += telegramAlbumSize {
+		end := start + telegramAlbumSize
+		if end > len(slices) {
+			end = len(slices)
+		}
+
+		var items []albumPhoto
+		for i := start; i < end; i++ {
+			slice, err := fitTelegramPhoto(slices[i])
+			if err != nil {
+				log.WithFields(log.Fields{
+					"url":   media.URL,
+					"index": i,
+					"error": err,
+				}).Error("Fit photo slice failed")
+				return tgbotapi.Message{}, err
+			}
+
+			item := albumPhoto{
+				file:       tgbotapi.FileBytes{Name: fmt.Sprintf("%d_%s", i+1, media.FileName), Bytes: slice},
+				HasSpoiler: target.spoiler,
+			}
+			if i == 0 {
+				item.Caption = target.caption
+				item.ParseMode = "MarkdownV2"
+			}
+			items = append(items, item)
+		}
+
+		replyTo := target.replyTo
+		if first != nil {
+			replyTo = first.MessageID
+		}
+
+		messages, err := s.sendAlbum(items, target, replyTo)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   media.URL,
+				"error": err,
+			}).Error("Send photo slices failed")
+			return tgbotapi.Message{}, err
+		}
+		if first == nil && len(messages) > 0 {
+			first = &messages[0]
+		}
+		for i := range messages {
+			albumIDs = append(albumIDs, messages[i].MessageID)
+			album = append(album, PostRefOf(&messages[i]))
 		}
-	} else {
-		result += "\n"
 	}
-	if media.Source != "" {
-		result += ("来源: [" + media.Service + "](" + media.Source + ")\n")
+
+	if first == nil {
+		return tgbotapi.Message{}, errors.New("no slice sent")
 	}
-	return result
+	if target.embed {
+		return *first, nil
+	}
+
+	likeButton := tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.like"), s.likeBtnAction)
+	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(likeButton))
+	config := tgbotapi.NewMessageToChannel(target.chat, Translate(s.language, "slices.notice", len(slices)))
+	config.ReplyToMessageID = first.MessageID
+	config.ReplyMarkup = keyboardMarkup
+
+	message, err := s.send(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   media.URL,
+			"error": err,
+		}).Error("Send slices like button failed")
+		return message, err
+	}
+
+	s.linkPost(message.Chat.ID, message.MessageID, media.Identity, false, albumIDs...)
+	if err := db.SetPostAlbum(message.Chat.ID, message.MessageID, album); err != nil {
+		log.WithFields(log.Fields{
+			"identity": media.Identity,
+			"error":    err,
+		}).Error("Record post album failed")
+	}
+
+	return message, nil
 }
 
-func escape(origin string) string {
-	var arrowRe = regexp.MustCompile(`<.+?>`)
-	var escapeRe = regexp.MustCompile("(\\.|_|\\*|\\[|\\]|\\(|\\)|\\~|>|#|\\+|-|=|\\||\\{|\\}|!|`)")
-	s := arrowRe.ReplaceAllString(origin, " ")
-	s = escapeRe.ReplaceAllString(s, `\$1`)
-	return s
+// albumPhoto is a photo of a media group, InputMediaPhoto of the bot api library has no has_spoiler
+type albumPhoto struct {
+	Type       string `json:"type"`
+	Media      string `json:"media"`
+	Caption    string `json:"caption,omitempty"`
+	ParseMode  string `json:"parse_mode,omitempty"`
+	HasSpoiler bool   `json:"has_spoiler,omitempty"`
+	file       tgbotapi.RequestFileData
 }
 
-func zoomeLargeImage(original *[]byte, ratio float64) *[]byte {
-	log.WithField("ratio", ratio).Debug("Zoom")
-	image := bimg.NewImage(*original)
-	imageDimension, err := image.Size()
+func (s TelegramService) sendAlbum(items []albumPhoto, target sendTarget, replyTo int) ([]tgbotapi.Message, error) {
+	params := tgbotapi.Params{}
+	params.AddNonEmpty("chat_id", target.chat)
+	params.AddNonZero("reply_to_message_id", replyTo)
+
+	var files []tgbotapi.RequestFile
+	for i := range items {
+		name := fmt.Sprintf("file-%d", i)
+		items[i].Type = "photo"
+		items[i].Media = "attach://" + name
+		files = append(files, tgbotapi.RequestFile{Name: name, Data: items[i].file})
+	}
+	if err := params.AddInterface("media", items); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.uploadFiles("sendMediaGroup", params, files, len(items))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return &[]byte{}
-	}
-
-	log.WithFields(log.Fields{
-		"Width":  imageDimension.Width,
-		"Height": imageDimension.Height,
-	}).Debug("Original image dimension")
-	newWidth := int(float64(imageDimension.Width) * ratio)
-	newHeight := int(float64(imageDimension.Height) * ratio)
-	log.WithFields(log.Fields{
-		"Width":  newWidth,
-		"Height": newHeight,
-	}).Debug("New image dimension")
-
-	newImage, err := image.Resize(newWidth, newHeight)
+		return nil, err
+	}
+
+	var messages []tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &messages)
+
+	return messages, err
+}
+
+// sendMediaFile sends a photo, video, animation or document post with the like button. The bot api
+// library has no has_spoiler, and no width or height for videos, so the request is built by hand
+func (s TelegramService) sendMediaFile(media *Media, mediaType string, file tgbotapi.RequestFileData, target sendTarget) (tgbotapi.Message, error) {
+	likeButton := tgbotapi.NewInlineKeyboardButtonData(Translate(s.language, "button.like"), s.likeBtnAction)
+	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(likeButton))
+
+	method := map[string]string{
+		"photo":     "sendPhoto",
+		"video":     "sendVideo",
+		"animation": "sendAnimation",
+		"document":  "sendDocument",
+	}[mediaType]
+
+	params := tgbotapi.Params{}
+	params.AddNonEmpty("chat_id", target.chat)
+	params.AddNonEmpty("caption", target.caption)
+	params.AddNonEmpty("parse_mode", "MarkdownV2")
+	params.AddNonZero("reply_to_message_id", target.replyTo)
+	if mediaType != "document" {
+		params.AddBool("has_spoiler", target.spoiler)
+	}
+	if target.keyboard != nil {
+		if err := params.AddInterface("reply_markup", target.keyboard); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	} else if !target.embed {
+		if err := params.AddInterface("reply_markup", keyboardMarkup); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+
+	files := []tgbotapi.RequestFile{{Name: mediaType, Data: file}}
+	if mediaType == "video" || mediaType == "animation" {
+		params.AddNonZero("width", media.Width)
+		params.AddNonZero("height", media.Height)
+		params.AddNonZero("duration", media.Duration)
+		if mediaType == "video" {
+			params.AddBool("supports_streaming", true)
+		}
+		if media.Thumbnail != nil {
+			files = append(files, tgbotapi.RequestFile{
+				Name: "thumb",
+				Data: tgbotapi.FileBytes{Name: "thumb.jpg", Bytes: *media.Thumbnail},
+			})
+		}
+	}
+
+	resp, err := s.uploadFiles(method, params, files, 1)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return &[]byte{}
+		return tgbotapi.Message{}, err
 	}
 
-	return &newImage
+	var message tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &message)
+
+	return message, err
+}
+
+// send runs a request through the scheduler, in the queue of its chat
+func (s TelegramService) send(config tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := s.scheduler.Do(chatOfConfig(config), 1, func() error {
+		var err error
+		message, err = s.bot.Send(config)
+		return err
+	})
+
+	return message, err
+}
+
+// request runs a request whose result isn't a message, such as a deletion, through the scheduler
+func (s TelegramService) request(config tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	err := s.scheduler.Do(chatOfConfig(config), 1, func() error {
+		var err error
+		resp, err = s.bot.Request(config)
+		return err
+	})
+
+	return resp, err
+}
+
+// SeedChatAliases looks up the ids of the channels addressed by @username, so requests by id share their
+// queue from the start instead of after the first post
+func (s TelegramService) SeedChatAliases() {
+	channels := append([]string{s.channelName, s.sensitiveChannel}, viper.GetStringSlice("telegram.transform_channels")...)
+	for _, channel := range channels {
+		if !strings.HasPrefix(channel, "@") {
+			continue
+		}
+
+		resp, err := s.request(tgbotapi.ChatInfoConfig{ChatConfig: tgbotapi.ChatConfig{SuperGroupUsername: channel}})
+		var chat tgbotapi.Chat
+		if err == nil {
+			err = json.Unmarshal(resp.Result, &chat)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"chat":  channel,
+				"error": err,
+			}).Error("Get chat failed")
+			continue
+		}
+		s.scheduler.Alias(chat.ID, channel)
+	}
+}
+
+func (s TelegramService) sendMediaGroup(config tgbotapi.MediaGroupConfig) ([]tgbotapi.Message, error) {
+	var messages []tgbotapi.Message
+	err := s.scheduler.Do(chatOfConfig(config), len(config.Media), func() error {
+		var err error
+		messages, err = s.bot.SendMediaGroup(config)
+		return err
+	})
+
+	return messages, err
+}
+
+// uploadFiles is UploadFiles of the bot api through the scheduler, weight is the number of messages posted
+func (s TelegramService) uploadFiles(method string, params tgbotapi.Params, files []tgbotapi.RequestFile, weight int) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	err := s.scheduler.Do(chatOf(params), weight, func() error {
+		var err error
+		resp, err = s.bot.UploadFiles(method, params, files)
+		return err
+	})
+
+	return resp, err
 }
 
 func getLargestPhoto(msg *tgbotapi.Message) *tgbotapi.PhotoSize {
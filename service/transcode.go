@@ -0,0 +1,172 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// Bots upload files up to 50MB
+const telegramUploadSize = 50 * 1024 * 1024
+
+const transcodeAttempts = 4
+const transcodeAudioBitrate = 128 * 1000
+
+// Formats that are animations, whatever type the provider gave them
+var animationExtensions = map[string]bool{".gif": true, ".apng": true}
+
+// VideoTranscoder turns animations and videos into H.264 MP4 files Telegram plays inline
+type VideoTranscoder struct{}
+
+func NewVideoTranscoder() *VideoTranscoder {
+	return &VideoTranscoder{}
+}
+
+func mediaExtension(media *Media) string {
+	if ext := strings.ToLower(path.Ext(media.FileName)); ext != "" {
+		return ext
+	}
+	return strings.ToLower(path.Ext(strings.Split(media.URL, "?")[0]))
+}
+
+// Transform returns a downloaded copy of videos and animations, remuxed when Telegram plays them and
+// transcoded otherwise, the media itself is never modified
+func (t VideoTranscoder) Transform(media *Media) (*Media, error) {
+	if (media.Type != "video" && media.Type != "animation") || len(media.TGFileID) != 0 {
+		return media, nil
+	}
+
+	if media.File == nil {
+		// ffmpeg never opens remote urls, it would reach hosts and protocols the download guard refuses
+		file, err := downloadMedia(media)
+		if err != nil {
+			return media, err
+		}
+		downloaded := *media
+		downloaded.File = &file
+		media = &downloaded
+	}
+
+	return transcodeFile(media)
+}
+
+// transcodeFile remuxes playable files with faststart, everything else is encoded to H.264 with the
+// bitrate stepping down until it fits the upload limit
+func transcodeFile(media *Media) (*Media, error) {
+	ext := mediaExtension(media)
+	input, err := os.CreateTemp("", "transcode-*"+ext)
+	if err != nil {
+		return media, err
+	}
+	defer os.Remove(input.Name())
+	_, err = input.Write(*media.File)
+	input.Close()
+	if err != nil {
+		return media, err
+	}
+
+	outputPath := input.Name() + ".mp4"
+	defer os.Remove(outputPath)
+
+	probe, err := probeMedia(input.Name(), ffmpeg.KwArgs{})
+	if err != nil {
+		return media, err
+	}
+
+	isAnimation := media.Type == "animation" || animationExtensions[ext]
+	var output []byte
+
+	if probe.playable() && len(*media.File) <= telegramUploadSize {
+		// only move the index to the front, so playback starts before the download ends
+		output, err = runFFmpeg(input.Name(), outputPath, ffmpeg.KwArgs{"c": "copy", "movflags": "+faststart"})
+	} else {
+		output, err = encodeVideoWithinSize(input.Name(), outputPath, probe, isAnimation)
+	}
+	if err != nil {
+		return media, err
+	}
+
+	log.WithFields(log.Fields{
+		"url":      media.URL,
+		"original": len(*media.File),
+		"size":     len(output),
+	}).Info("Transcoded media")
+
+	result := *media
+	result.File = &output
+	result.FileName = strings.TrimSuffix(media.FileName, path.Ext(media.FileName)) + ".mp4"
+	if isAnimation {
+		result.Type = "animation"
+	}
+
+	return &result, nil
+}
+
+func encodeVideoWithinSize(inputPath string, outputPath string, probe *probeResult, isAnimation bool) ([]byte, error) {
+	args := ffmpeg.KwArgs{
+		"c:v":      "libx264",
+		"preset":   "veryfast",
+		"pix_fmt":  "yuv420p",
+		"vf":       "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"movflags": "+faststart",
+		"crf":      23,
+	}
+	audioBitrate := 0
+	if isAnimation || probe.stream("audio") == nil {
+		args["an"] = ""
+	} else {
+		args["c:a"] = "aac"
+		args["b:a"] = fmt.Sprintf("%dk", transcodeAudioBitrate/1000)
+		audioBitrate = transcodeAudioBitrate
+	}
+
+	duration := probe.duration()
+	bitrate := 0
+	for attempt := 0; attempt < transcodeAttempts; attempt++ {
+		output, err := runFFmpeg(inputPath, outputPath, args)
+		if err != nil {
+			return nil, err
+		}
+		if len(output) <= telegramUploadSize {
+			return output, nil
+		}
+		if duration <= 0 {
+			break
+		}
+
+		// aim a little under the limit first, then step down by a quarter
+		if bitrate == 0 {
+			bitrate = int(float64(telegramUploadSize*8)*0.9/duration) - audioBitrate
+		} else {
+			bitrate = bitrate * 3 / 4
+		}
+		if bitrate <= 0 {
+			break
+		}
+
+		log.WithField("bitrate", bitrate).Info("Transcoded file too large, lower bitrate")
+		delete(args, "crf")
+		args["b:v"] = fmt.Sprintf("%dk", bitrate/1000)
+		args["maxrate"] = fmt.Sprintf("%dk", bitrate/1000)
+		args["bufsize"] = fmt.Sprintf("%dk", bitrate*2/1000)
+	}
+
+	return nil, fmt.Errorf("unable to transcode into %d bytes", telegramUploadSize)
+}
+
+func runFFmpeg(inputPath string, outputPath string, args ffmpeg.KwArgs) ([]byte, error) {
+	err := ffmpeg.Input(inputPath, ffmpeg.KwArgs{}).
+		Output(outputPath, args).
+		OverWriteOutput().
+		ErrorToStdOut().
+		Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(outputPath)
+}
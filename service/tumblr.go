@@ -1,83 +1,527 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+const tumblrAPIPrefix = "https://api.tumblr.com/v2/blog/"
+const tumblrBlogPrefix = "https://www.tumblr.com/"
+
+// custom domain lookups run while matching urls, keep them short and their cache small
+const (
+	tumblrCNAMETimeout     = 2 * time.Second
+	tumblrDomainTTL        = 24 * time.Hour
+	tumblrDomainFailureTTL = 10 * time.Minute
+	tumblrDomainCacheLimit = 1024
+)
+
+// Hosts of other providers and big sites, a /post/<n> path on them is never a Tumblr blog
+var tumblrForeignHosts = []string{"x.com", "twitter.com", "pixiv.net", "instagram.com", "bsky.app", "donmai.us", "misskey.io", "misskey.design", "github.com", "reddit.com", "facebook.com", "youtube.com"}
+
+type tumblrDomainEntry struct {
+	tumblr  bool
+	expires time.Time
+}
+
 type TumblrService struct {
-	Service   Type
-	urlRegexp *regexp.Regexp
-	client    *http.Client
+	Service         Type
+	blogRegexp      *regexp.Regexp
+	dashboardRegexp *regexp.Regexp
+	customRegexp    *regexp.Regexp
+	consumerKey     string
+	customDomains   []string
+	client          *http.Client
+	domainMu        sync.Mutex
+	domainCache     map[string]tumblrDomainEntry
+}
+
+// TumblrMedia is a single rendition of an NPF media object
+type TumblrMedia struct {
+	URL                   string
+	Type                  string
+	Width                 int
+	Height                int
+	HasOriginalDimensions bool `json:"has_original_dimensions"`
+}
+
+// TumblrBlock is an NPF content block
+type TumblrBlock struct {
+	Type     string
+	Text     string
+	URL      string
+	Provider string
+	AltText  string `json:"alt_text"`
+	// a list of renditions for images, a single object for videos
+	Media json.RawMessage
+}
+
+type TumblrBlog struct {
+	Name string
+	URL  string
+}
+
+type TumblrPost struct {
+	IDString string `json:"id_string"`
+	BlogName string `json:"blog_name"`
+	PostURL  string `json:"post_url"`
+	Blog     TumblrBlog
+	Tags     []string
+	Content  []TumblrBlock
+	Trail    []struct {
+		Blog    TumblrBlog
+		Content []TumblrBlock
+	}
 }
 
 func NewTumblrService() *TumblrService {
 	return &TumblrService{
-		Service:   Tumblr,
-		urlRegexp: regexp.MustCompile(`(?i)https?:\/\/\w+\.tumblr\.com\/post\/.+`),
-		client:    &http.Client{},
+		Service: Tumblr,
+		// https://blog.tumblr.com/post/123/slug
+		blogRegexp: regexp.MustCompile(`(?i)https?:\/\/([\w-]+)\.tumblr\.com\/post\/(\d+)`),
+		// https://www.tumblr.com/blog/123/slug, https://www.tumblr.com/blog/view/blog/123
+		dashboardRegexp: regexp.MustCompile(`(?i)https?:\/\/(?:www\.)?tumblr\.com\/(?:blog\/view\/)?([\w-]+)\/(\d+)`),
+		// https://custom.domain/post/123/slug
+		customRegexp:  regexp.MustCompile(`(?i)https?:\/\/([\w.-]+)\/post\/(\d+)`),
+		consumerKey:   viper.GetString("tumblr.consumer_key"),
+		customDomains: viper.GetStringSlice("tumblr.custom_domains"),
+		client:        &http.Client{},
+		domainCache:   make(map[string]tumblrDomainEntry),
 	}
 }
 
-func (s TumblrService) CheckValid(urlString string) (*IncomingURL, bool) {
-	match := s.urlRegexp.FindStringSubmatch(urlString)
-	if match == nil {
+func (s *TumblrService) CheckValid(urlString string) (*IncomingURL, bool) {
+	return s.match(urlString, s.isCustomDomain)
+}
+
+// CheckValidOffline only matches the configured custom domains
+func (s *TumblrService) CheckValidOffline(urlString string) (*IncomingURL, bool) {
+	return s.match(urlString, s.isConfiguredDomain)
+}
+
+func (s *TumblrService) match(urlString string, isCustomDomain func(host string) bool) (*IncomingURL, bool) {
+	var blog, strID, normalizedURL string
+
+	if match := s.blogRegexp.FindStringSubmatch(urlString); match != nil && !strings.EqualFold(match[1], "www") {
+		blog = strings.ToLower(match[1])
+		strID = match[2]
+		normalizedURL = fmt.Sprintf("%s%s/%s", tumblrBlogPrefix, blog, strID)
+	} else if match := s.dashboardRegexp.FindStringSubmatch(urlString); match != nil {
+		blog = strings.ToLower(match[1])
+		strID = match[2]
+		normalizedURL = fmt.Sprintf("%s%s/%s", tumblrBlogPrefix, blog, strID)
+	} else if match := s.customRegexp.FindStringSubmatch(urlString); match != nil && isCustomDomain(match[1]) {
+		// the API accepts a custom domain as the blog identifier
+		blog = strings.ToLower(match[1])
+		strID = match[2]
+		normalizedURL = fmt.Sprintf("https://%s/post/%s", blog, strID)
+	} else {
 		return nil, false
 	}
 
+	intID, _ := strconv.Atoi(strID)
+
 	return &IncomingURL{
-		Service:  Tumblr,
+		Service:  s.Service,
 		Original: urlString,
-		URL:      match[0],
+		URL:      normalizedURL,
+		Host:     blog,
+		StrID:    strID,
+		IntID:    intID,
 	}, true
 }
 
-func (s TumblrService) IsService(serviceType Type) bool {
+func (s *TumblrService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
-func (s TumblrService) ExtractMediaFromURL(incomingURL *IncomingURL) (result []*Media, err error) {
+// Identity uses the post id only, it is unique across blogs and survives blog renames
+func (s *TumblrService) Identity(incomingURL *IncomingURL) string {
+	return "tumblr:" + incomingURL.StrID
+}
+
+func (s *TumblrService) isConfiguredDomain(host string) bool {
+	for _, domain := range s.customDomains {
+		if strings.EqualFold(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCustomDomain reports whether the host is a blog on its own domain, either configured
+// or pointing to Tumblr via CNAME
+func (s *TumblrService) isCustomDomain(host string) bool {
+	host = strings.ToLower(host)
+	if s.isConfiguredDomain(host) {
+		return true
+	}
+
+	for _, foreign := range tumblrForeignHosts {
+		if host == foreign || strings.HasSuffix(host, "."+foreign) {
+			return false
+		}
+	}
+
+	s.domainMu.Lock()
+	entry, ok := s.domainCache[host]
+	s.domainMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.tumblr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tumblrCNAMETimeout)
+	defer cancel()
+	cname, err := net.DefaultResolver.LookupCNAME(ctx, host)
+	result := err == nil && strings.HasSuffix(strings.ToLower(cname), "domains.tumblr.com.")
+	ttl := tumblrDomainTTL
+	if err != nil {
+		ttl = tumblrDomainFailureTTL
+	}
+
+	s.domainMu.Lock()
+	if len(s.domainCache) >= tumblrDomainCacheLimit {
+		s.domainCache = make(map[string]tumblrDomainEntry)
+	}
+	s.domainCache[host] = tumblrDomainEntry{tumblr: result, expires: time.Now().Add(ttl)}
+	s.domainMu.Unlock()
+
+	return result
+}
+
+func (s *TumblrService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media, error) {
+	var post *TumblrPost
+	var err error
+
+	if s.consumerKey != "" {
+		post, err = s.fetchPostFromAPI(incomingURL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   incomingURL.URL,
+				"error": err,
+			}).Warn("Get tumblr post from API failed, fall back to public page")
+		}
+	}
+
+	if post == nil {
+		post, err = s.fetchPostFromPage(incomingURL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   incomingURL.URL,
+				"error": err,
+			}).Error("Get tumblr post failed")
+			return nil, err
+		}
+	}
+
+	return s.extractMediaFromPost(post, incomingURL), nil
+}
+
+func (s *TumblrService) fetchPostFromAPI(incomingURL *IncomingURL) (*TumblrPost, error) {
+	query := url.Values{}
+	query.Set("id", incomingURL.StrID)
+	query.Set("npf", "true")
+	query.Set("api_key", s.consumerKey)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s/posts?%s", tumblrAPIPrefix, incomingURL.Host, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := s.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	m := struct {
+		Response struct {
+			Posts []TumblrPost
+		}
+	}{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Response.Posts) == 0 {
+		return nil, fmt.Errorf("tumblr post %s not found", incomingURL.StrID)
+	}
+
+	return &m.Response.Posts[0], nil
+}
+
+var tumblrInitialStateRegex = regexp.MustCompile(`(?s)window\['___INITIAL_STATE___'\]\s*=\s*(\{.+?\});\s*</script>`)
+
+var tumblrBlogNameRegex = regexp.MustCompile(`blogName=([\w-]+)`)
+
+// blogName is the Tumblr name of the blog, custom domains name it in the app links of their post page
+func (s *TumblrService) blogName(incomingURL *IncomingURL) (string, error) {
+	if !strings.Contains(incomingURL.Host, ".") {
+		return incomingURL.Host, nil
+	}
+
 	req, err := http.NewRequest("GET", incomingURL.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/111.0.0.0 Safari/537.36")
+
+	body, err := s.doRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	match := tumblrBlogNameRegex.FindSubmatch(body)
+	if match == nil {
+		return "", fmt.Errorf("no blog name found on %s", incomingURL.Host)
+	}
+	return strings.ToLower(string(match[1])), nil
+}
+
+// fetchPostFromPage reads the NPF post from the initial state embedded in the public post page
+func (s *TumblrService) fetchPostFromPage(incomingURL *IncomingURL) (*TumblrPost, error) {
+	blog, err := s.blogName(incomingURL)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := s.client.Do(req)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s/%s", tumblrBlogPrefix, blog, incomingURL.StrID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/111.0.0.0 Safari/537.36")
+
+	body, err := s.doRequest(req)
 	if err != nil {
 		return nil, err
 	}
 
+	match := tumblrInitialStateRegex.FindSubmatch(body)
+	if match == nil {
+		return nil, fmt.Errorf("no initial state found in tumblr page")
+	}
+
+	var state interface{}
+	if err := json.Unmarshal(match[1], &state); err != nil {
+		return nil, err
+	}
+
+	// the web client uses camelCase keys, bring them in line with the API
+	postObject := findTumblrPostObject(snakeCaseKeys(state), incomingURL.StrID)
+	if postObject == nil {
+		return nil, fmt.Errorf("tumblr post %s not found in initial state", incomingURL.StrID)
+	}
+
+	postJSON, err := json.Marshal(postObject)
+	if err != nil {
+		return nil, err
+	}
+
+	var post TumblrPost
+	if err := json.Unmarshal(postJSON, &post); err != nil {
+		return nil, err
+	}
+
+	return &post, nil
+}
+
+func (s *TumblrService) doRequest(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	re := regexp.MustCompile(`(?i)src="(https?:\/\/\d+\.media\.tumblr\.com\/\w+\/)(tumblr_\w+_)(\d+)\.(jpe?g|gif|png|)`)
-	match := re.FindSubmatch(body)
 
-	if match == nil {
-		return
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
 	}
 
-	fileName := fmt.Sprintf("%s.%s", match[2][:len(match[2])-1], match[4])
-	imageURL := fmt.Sprintf("%s%s1280.%s", match[1], match[2], match[4])
-	var imageType string
-	if string(match[4]) == "gif" {
-		imageType = "video"
-	} else {
-		imageType = "photo"
+	return body, nil
+}
+
+func (s *TumblrService) extractMediaFromPost(post *TumblrPost, incomingURL *IncomingURL) []*Media {
+	var result []*Media
+
+	// reblogged content lives in the trail, the post content is what the reblogger added
+	author := post.BlogName
+	if author == "" {
+		author = post.Blog.Name
 	}
-	media := Media{
-		FileName: fileName,
-		URL:      imageURL,
-		Type:     imageType,
-		Source:   incomingURL.URL,
-		Service:  string(s.Service),
+	var blocks []TumblrBlock
+	for _, item := range post.Trail {
+		if len(blocks) == 0 && item.Blog.Name != "" {
+			author = item.Blog.Name
+		}
+		blocks = append(blocks, item.Content...)
 	}
-	result = append(result, &media)
+	blocks = append(blocks, post.Content...)
 
-	return result, nil
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+
+	for _, block := range blocks {
+		var media *Media
+
+		switch block.Type {
+		case "image":
+			media = s.extractImage(&block)
+		case "video":
+			media = s.extractVideo(&block)
+		default:
+			continue
+		}
+
+		if media == nil {
+			continue
+		}
+
+		media.Source = incomingURL.URL
+		media.Service = string(s.Service)
+		media.Author = author
+		media.AuthorURL = tumblrBlogPrefix + author
+		media.Description = strings.Join(texts, "\n")
+		media.AltText = block.AltText
+		media.Tags = post.Tags
+		result = append(result, media)
+	}
+
+	return result
+}
+
+func (s *TumblrService) extractImage(block *TumblrBlock) *Media {
+	var renditions []TumblrMedia
+	if err := json.Unmarshal(block.Media, &renditions); err != nil || len(renditions) == 0 {
+		return nil
+	}
+
+	// prefer the original upload, otherwise the widest rendition
+	best := renditions[0]
+	for _, rendition := range renditions {
+		if rendition.HasOriginalDimensions {
+			best = rendition
+			break
+		}
+		if rendition.Width > best.Width {
+			best = rendition
+		}
+	}
+
+	mediaType := "photo"
+	if best.Type == "image/gif" || strings.HasSuffix(strings.ToLower(best.URL), ".gif") {
+		mediaType = "animation"
+	}
+
+	return &Media{
+		FileName: tumblrFileName(best.URL),
+		URL:      best.URL,
+		Type:     mediaType,
+	}
+}
+
+func (s *TumblrService) extractVideo(block *TumblrBlock) *Media {
+	// only videos hosted by tumblr can be downloaded, skip youtube and friends
+	if block.Provider != "" && block.Provider != "tumblr" {
+		return nil
+	}
+
+	var video TumblrMedia
+	if err := json.Unmarshal(block.Media, &video); err != nil || video.URL == "" {
+		return nil
+	}
+
+	return &Media{
+		FileName: tumblrFileName(video.URL),
+		URL:      video.URL,
+		Type:     "video",
+	}
+}
+
+func tumblrFileName(mediaURL string) string {
+	urlParts := strings.Split(mediaURL, "/")
+	fileName := urlParts[len(urlParts)-1]
+	if idx := strings.Index(fileName, "?"); idx != -1 {
+		fileName = fileName[:idx]
+	}
+	return fileName
+}
+
+// findTumblrPostObject walks the page state looking for the post with the given id
+func findTumblrPostObject(node interface{}, id string) map[string]interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if value["id_string"] == id || value["id"] == id {
+			if _, ok := value["content"]; ok {
+				return value
+			}
+		}
+		for _, child := range value {
+			if found := findTumblrPostObject(child, id); found != nil {
+				return found
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if found := findTumblrPostObject(child, id); found != nil {
+				return found
+			}
+		}
+	}
+
+	return nil
+}
+
+// snakeCaseKeys converts every object key from camelCase to snake_case
+func snakeCaseKeys(node interface{}) interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			result[toSnakeCase(key)] = snakeCaseKeys(child)
+		}
+		return result
+	case []interface{}:
+		for i, child := range value {
+			value[i] = snakeCaseKeys(child)
+		}
+		return value
+	}
+
+	return node
+}
+
+func toSnakeCase(key string) string {
+	var builder strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				builder.WriteByte('_')
+			}
+			builder.WriteRune(unicode.ToLower(r))
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
 }
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -63,6 +65,11 @@ func (s TwitterService) IsService(serviceType Type) bool {
 	return serviceType == s.Service
 }
 
+// Identity ignores the screen name, it changes on rename and is "i" in /i/status/ links
+func (s TwitterService) Identity(incomingURL *IncomingURL) string {
+	return "twitter:" + incomingURL.StrID
+}
+
 type TweetResponse struct {
 	Data struct {
 		ThreadedConversationWithInjectionsV2 struct {
@@ -87,10 +94,14 @@ type TweetCore struct {
 }
 
 type TweetLegacy struct {
-	FullText         string `json:"full_text"`
-	DisplayTextRange []int  `json:"display_text_range"`
-	Entities         struct {
-		Media []EntityMedia
+	FullText          string `json:"full_text"`
+	PossiblySensitive bool   `json:"possibly_sensitive"`
+	DisplayTextRange  []int  `json:"display_text_range"`
+	Entities          struct {
+		Media        []EntityMedia
+		Urls         []EntityURL
+		UserMentions []EntityMention `json:"user_mentions"`
+		Hashtags     []EntityHashtag
 	}
 	ExtendedEntities struct {
 		Media []EntityMedia
@@ -115,10 +126,32 @@ type TweetEntity struct {
 	}
 }
 
+// Indices of entities count runes of the unescaped full_text
+type EntityURL struct {
+	ExpandedURL string `json:"expanded_url"`
+	DisplayURL  string `json:"display_url"`
+	Indices     []int
+}
+
+type EntityMention struct {
+	ScreenName string `json:"screen_name"`
+	Indices    []int
+}
+
+type EntityHashtag struct {
+	Text    string
+	Indices []int
+}
+
 type EntityMedia struct {
 	Type          string
+	Indices       []int
 	MediaUrlHttps string `json:"media_url_https"`
-	VideoInfo     struct {
+	OriginalInfo  struct {
+		Width  int
+		Height int
+	} `json:"original_info"`
+	VideoInfo struct {
 		Variants []struct {
 			ContentType string `json:"content_type"`
 			Url         string
@@ -240,7 +273,65 @@ func (s TwitterService) ExtractMediaFromURL(incomingURL *IncomingURL) ([]*Media,
 func (s TwitterService) completeMediaMeta(media *Media, tweetLegacy *TweetLegacy, tweetCore *TweetCore) {
 	media.Author = tweetCore.UserResults.Result.Legacy.Name
 	media.AuthorURL = twitterUserPrefix + tweetCore.UserResults.Result.Legacy.ScreenName
-	media.Description = string([]rune(tweetLegacy.FullText)[tweetLegacy.DisplayTextRange[0]:tweetLegacy.DisplayTextRange[1]])
+	setDescription(media, tweetRichText(tweetLegacy))
+	media.Sensitive = tweetLegacy.PossiblySensitive
+}
+
+// tweetRichText expands t.co links, links mentions and hashtags, and drops the media links
+func tweetRichText(tweetLegacy *TweetLegacy) RichText {
+	runes := []rune(html.UnescapeString(tweetLegacy.FullText))
+	start, end := 0, len(runes)
+	if len(tweetLegacy.DisplayTextRange) == 2 {
+		start, end = tweetLegacy.DisplayTextRange[0], tweetLegacy.DisplayTextRange[1]
+	}
+	if start < 0 || end > len(runes) || start > end {
+		start, end = 0, len(runes)
+	}
+
+	// byte offsets into the displayed text, from rune indices into the whole text
+	offset := func(index int) int {
+		if index < start {
+			index = start
+		}
+		if index > end {
+			index = end
+		}
+		return len(string(runes[start:index]))
+	}
+	entityRange := func(indices []int) (textRange, bool) {
+		if len(indices) != 2 {
+			return textRange{}, false
+		}
+		return textRange{start: offset(indices[0]), end: offset(indices[1])}, true
+	}
+
+	var ranges []textRange
+	for _, entity := range tweetLegacy.Entities.Urls {
+		if r, ok := entityRange(entity.Indices); ok {
+			r.url, r.text = entity.ExpandedURL, entity.DisplayURL
+			ranges = append(ranges, r)
+		}
+	}
+	for _, entity := range tweetLegacy.Entities.UserMentions {
+		if r, ok := entityRange(entity.Indices); ok {
+			r.url = twitterUserPrefix + entity.ScreenName
+			ranges = append(ranges, r)
+		}
+	}
+	for _, entity := range tweetLegacy.Entities.Hashtags {
+		if r, ok := entityRange(entity.Indices); ok {
+			r.url = "https://x.com/hashtag/" + url.PathEscape(entity.Text)
+			ranges = append(ranges, r)
+		}
+	}
+	for _, entity := range tweetLegacy.Entities.Media {
+		if r, ok := entityRange(entity.Indices); ok {
+			r.drop = true
+			ranges = append(ranges, r)
+		}
+	}
+
+	return richTextFromRanges(string(runes[start:end]), ranges)
 }
 
 func (s TwitterService) extractPhoto(media *EntityMedia) *Media {
@@ -252,6 +343,8 @@ func (s TwitterService) extractPhoto(media *EntityMedia) *Media {
 		FileName: fileName,
 		URL:      media.MediaUrlHttps,
 		Type:     "photo",
+		Width:    media.OriginalInfo.Width,
+		Height:   media.OriginalInfo.Height,
 	}
 }
 